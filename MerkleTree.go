@@ -32,18 +32,30 @@ func NewMerkleNode(left, right *MerkleNode, data []byte) *MerkleNode {
 
 }
 
+// NewMerkleTree builds the tree over data, hashing levels until one node
+// is left. Trees of up to four leaves have the same root they always had;
+// larger ones used to stop after len(data)/2 levels and index past the
+// end of a level.
 func NewMerkleTree(data [][]byte) *MerkleTree {
 	var nodes []MerkleNode
 
+	// Copy before repeating the last leaf, so it doesn't overwrite what
+	// follows data in the caller's array.
 	if len(data)%2 != 0 {
-		data = append(data, data[len(data)-1])
+		data = append(data[:len(data):len(data)], data[len(data)-1])
 	}
 
 	for _, datum := range data {
 		node := NewMerkleNode(nil, nil, datum)
 		nodes = append(nodes, *node)
 	}
-	for i := 0; i < len(data)/2; i++ {
+	// Each level pairs up the nodes of the one below, repeating the last
+	// node of a level with an odd count.
+	for len(nodes) > 1 {
+		if len(nodes)%2 != 0 {
+			nodes = append(nodes, nodes[len(nodes)-1])
+		}
+
 		var newLevel []MerkleNode
 		for j := 0; j < len(nodes); j += 2 {
 			node := NewMerkleNode(&nodes[j], &nodes[j+1], nil)
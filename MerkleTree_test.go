@@ -0,0 +1,57 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"testing"
+)
+
+func merkleHash(data ...[]byte) []byte {
+	hash := sha256.Sum256(bytes.Join(data, nil))
+	return hash[:]
+}
+
+// TestNewMerkleTree checks roots worked out level by level, repeating the
+// last node of each level with an odd count.
+func TestNewMerkleTree(t *testing.T) {
+	var data [][]byte
+	var leaves [][]byte
+	for i := 0; i < 8; i++ {
+		data = append(data, []byte(fmt.Sprintf("tx%d", i)))
+		leaves = append(leaves, merkleHash(data[i]))
+	}
+	h := func(i int) []byte { return leaves[i] }
+	pair := merkleHash
+
+	tests := []struct {
+		leaves int
+		root   []byte
+	}{
+		{1, pair(h(0), h(0))},
+		{2, pair(h(0), h(1))},
+		{3, pair(pair(h(0), h(1)), pair(h(2), h(2)))},
+		{5, pair(
+			pair(pair(h(0), h(1)), pair(h(2), h(3))),
+			pair(pair(h(4), h(4)), pair(h(4), h(4))),
+		)},
+		{8, pair(
+			pair(pair(h(0), h(1)), pair(h(2), h(3))),
+			pair(pair(h(4), h(5)), pair(h(6), h(7))),
+		)},
+	}
+	for _, test := range tests {
+		root := NewMerkleTree(data[:test.leaves]).RootNode.Data
+		if !bytes.Equal(root, test.root) {
+			t.Errorf("%d leaves: root = %x, want %x", test.leaves, root, test.root)
+		}
+	}
+}
+
+func TestNewMerkleTreeKeepsData(t *testing.T) {
+	data := [][]byte{[]byte("tx0"), []byte("tx1"), []byte("tx2")}
+	NewMerkleTree(data[:1])
+	if string(data[1]) != "tx1" {
+		t.Errorf("data[1] = %q after building a tree of data[:1], want %q", data[1], "tx1")
+	}
+}
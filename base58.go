@@ -13,7 +13,8 @@ func ReverseBytes(data []byte) {
 	}
 }
 
-// Base58Encode encodes a byte array to Base58
+// Base58Encode encodes a byte array to Base58, with a leading '1' for
+// each leading zero byte.
 func Base58Encode(input []byte) []byte {
 	var result []byte
 
@@ -29,7 +30,7 @@ func Base58Encode(input []byte) []byte {
 	}
 
 	ReverseBytes(result)
-	for b := range input {
+	for _, b := range input {
 		if b == 0x00 {
 			result = append([]byte{b58Alphabet[0]}, result...)
 		} else {
@@ -40,15 +41,17 @@ func Base58Encode(input []byte) []byte {
 	return result
 }
 
-// Base58Decode decodes Base58-encoded data
+// Base58Decode decodes Base58-encoded data, with a leading zero byte for
+// each leading '1'.
 func Base58Decode(input []byte) []byte {
 	result := big.NewInt(0)
 	zeroBytes := 0
 
-	for b := range input {
-		if b == 0x00 {
-			zeroBytes++
+	for _, b := range input {
+		if b != b58Alphabet[0] {
+			break
 		}
+		zeroBytes++
 	}
 
 	payload := input[zeroBytes:]
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+)
+
+// TestBase58RoundTrip checks addresses with the key and script versions,
+// 0x00 and 0x05, and other payloads with and without leading zero bytes,
+// each of which is encoded as a leading '1'.
+func TestBase58RoundTrip(t *testing.T) {
+	tests := []struct {
+		payload string
+		encoded string
+	}{
+		{"00000000000000000000000000000000000000000094a00911", "1111111111111111111114oLvT2"},
+		{"00751e76e8199196d454941c45d1b3a323f1433bd6510d1634", "1BgGZ9tcN4rm9KBzDn7KprQz87SZ26SAMH"},
+		{"050000000000000000000000000000000000000000dc8c61c4", "31h1vYVSYuKP6AhS86fbRdMw9XHieotbST"},
+		{"05751e76e8199196d454941c45d1b3a323f1433bd6d9615fcc", "3CNHUhP3uyB9EUtRLsmvFUmvGdjGdkTxJw"},
+		{"00000102", "115T"},
+		{"05", "6"},
+		{"", ""},
+	}
+	for _, test := range tests {
+		payload, err := hex.DecodeString(test.payload)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if encoded := Base58Encode(payload); string(encoded) != test.encoded {
+			t.Errorf("Base58Encode(%s) = %s, want %s", test.payload, encoded, test.encoded)
+		}
+		if decoded := Base58Decode([]byte(test.encoded)); !bytes.Equal(decoded, payload) {
+			t.Errorf("Base58Decode(%s) = %x, want %s", test.encoded, decoded, test.payload)
+		}
+	}
+}
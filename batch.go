@@ -0,0 +1,122 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Payment is one payout of a batch, as read from a payments file.
+type Payment struct {
+	Address string `json:"address"`
+	Amount  int    `json:"amount"`
+}
+
+// LoadPayments reads the payments in file: a JSON array of address and
+// amount objects if it ends in .json, and address,amount lines, optionally
+// under a header line, otherwise. Every address must be valid and every
+// amount positive.
+func LoadPayments(file string) []Payment {
+	var payments []Payment
+
+	if strings.EqualFold(filepath.Ext(file), ".json") {
+		content, err := ioutil.ReadFile(file)
+		if err != nil {
+			log.Panic(err)
+		}
+		err = json.Unmarshal(content, &payments)
+		if err != nil {
+			log.Panic(err)
+		}
+	} else {
+		f, err := os.Open(file)
+		if err != nil {
+			log.Panic(err)
+		}
+		defer f.Close()
+
+		r := csv.NewReader(f)
+		r.FieldsPerRecord = 2
+		r.TrimLeadingSpace = true
+		for line := 1; ; line++ {
+			record, err := r.Read()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				log.Panic(err)
+			}
+			if line == 1 && strings.EqualFold(record[1], "amount") {
+				continue
+			}
+			amount, err := strconv.Atoi(record[1])
+			if err != nil {
+				log.Panicf("ERROR: Invalid amount %q on line %d of %s", record[1], line, file)
+			}
+			payments = append(payments, Payment{record[0], amount})
+		}
+	}
+
+	if len(payments) == 0 {
+		log.Panicf("ERROR: No payments in %s", file)
+	}
+	for _, payment := range payments {
+		if !ValidateAddress(payment.Address) {
+			log.Panicf("ERROR: Invalid address %q", payment.Address)
+		}
+		if payment.Amount <= 0 {
+			log.Panicf("ERROR: Invalid amount %d to %s", payment.Amount, payment.Address)
+		}
+	}
+	return payments
+}
+
+// NewBatchTransactions returns the fewest transactions making payments
+// from from that each stay within maxStandardTxSize and a fee of maxFee,
+// paying them in order and each with a single change output. Fees are as
+// NewUTXOTransaction describes, for each transaction, and the transactions
+// spend different coins so they can be mined together.
+func NewBatchTransactions(from string, payments []Payment, fee, feeRate, maxFee int, replaceable bool, selector CoinSelector, bc *Blockchain) []*Transaction {
+	var outputs []TXOutput
+	for _, payment := range payments {
+		outputs = append(outputs, *NewTXOutput(payment.Amount, payment.Address))
+	}
+
+	redeemScript, sign := walletSigner(from, bc)
+
+	for batches := 1; ; batches++ {
+		batchSize := (len(outputs) + batches - 1) / batches
+		spent := make(map[string]bool)
+		var txs []*Transaction
+
+		for start := 0; start < len(outputs); start += batchSize {
+			end := start + batchSize
+			if end > len(outputs) {
+				end = len(outputs)
+			}
+
+			tx := fundTransaction(from, outputs[start:end], fee, feeRate, replaceable, excludingCoins{selector, spent}, redeemScript, bc, sign)
+			if batchSize > 1 && (tx.Size() > maxStandardTxSize || bc.TransactionFee(tx) > maxFee) {
+				txs = nil
+				break
+			}
+			checkMaxFee(tx, maxFee, bc)
+
+			for _, vin := range tx.Vin {
+				spent[hex.EncodeToString(outpointKey(vin.Txid, vin.Vout))] = true
+			}
+			txs = append(txs, tx)
+		}
+
+		if txs != nil {
+			return txs
+		}
+	}
+}
@@ -2,18 +2,20 @@ package main
 
 import (
 	"bytes"
-	"crypto/ecdsa"
+	"encoding/binary"
 	"encoding/hex"
 	"errors"
 	"fmt"
 	"log"
+	"sort"
 
 	"github.com/boltdb/bolt"
 )
 
 type Blockchain struct {
-	tip []byte
-	db  *bolt.DB
+	tip  []byte
+	db   *bolt.DB
+	utxo *UTXOCache
 }
 
 func (bc *Blockchain) MineBlock(transactions []*Transaction) *Block {
@@ -21,15 +23,13 @@ func (bc *Blockchain) MineBlock(transactions []*Transaction) *Block {
 	var lastHash []byte
 	var lastHeight int
 
-	for _, tx := range transactions {
-		if !bc.VerifyTransaction(tx) {
-			log.Panic("ERROR: Invalid transaction")
-		}
+	if !bc.VerifyTransactions(transactions) {
+		log.Panic("ERROR: Invalid transaction")
 	}
 
 	err := bc.db.View(func(tx *bolt.Tx) error {
 		b := tx.Bucket([]byte(blocksBucket))
-		lastHash = b.Get([]byte("l"))
+		lastHash = append([]byte{}, b.Get([]byte("l"))...)
 		blockData := b.Get(lastHash)
 		block := DeserializeBlock(blockData)
 		lastHeight = block.Height
@@ -42,63 +42,273 @@ func (bc *Blockchain) MineBlock(transactions []*Transaction) *Block {
 
 	newBlock := NewBlock(transactions, lastHash, lastHeight+1)
 
-	err = bc.db.Update(func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte(blocksBucket))
-		err = b.Put(newBlock.Hash, newBlock.Serialize())
-		err = b.Put([]byte("l"), newBlock.Hash)
-		return nil
-	})
+	err = bc.ConnectBlock(newBlock)
+	if err != nil {
+		log.Panic(err)
+	}
 	return newBlock
 }
 
 const dbFile = "blockchain.dat"
 const blocksBucket = "blocks"
+const medianTimeSpan = 11
 const coinbaseData = "Hello, World!"
 
 func NewBlockChain(address string) *Blockchain {
 
-	var tip []byte
-
 	db, err := bolt.Open(dbFile, 0600, nil)
 
 	if err != nil {
 		panic(err)
 	}
 
-	err = db.Update(func(tx *bolt.Tx) error {
+	bc := &Blockchain{nil, db, NewUTXOCache(db)}
+
+	var exists bool
+	err = db.View(func(tx *bolt.Tx) error {
 		b := tx.Bucket([]byte(blocksBucket))
+		if b != nil {
+			exists = true
+			bc.tip = append([]byte{}, b.Get([]byte("l"))...)
+		}
+		return nil
+	})
+	if err != nil {
+		panic(err)
+	}
 
-		if b == nil {
-			fmt.Printf("Creating new blockchain\n")
+	if exists {
+		fmt.Printf("Using db blockchain\n")
+		bc.recoverChainstate()
+		return bc
+	}
 
-			cbtx := NewCoinbaseTx(address, coinbaseData)
+	fmt.Printf("Creating new blockchain\n")
 
-			genesis := NewGenesisBlock(cbtx)
-			b, err := tx.CreateBucket([]byte(blocksBucket))
+	cbtx := NewCoinbaseTx(address, coinbaseData, 0)
+	genesis := NewGenesisBlock(cbtx)
 
+	err = bc.utxo.Commit(func(tx *bolt.Tx) error {
+		for _, name := range []string{blocksBucket, utxoBucket, addrIndexBucket, chainstateBucket} {
+			_, err := tx.CreateBucket([]byte(name))
 			if err != nil {
-				panic(err)
+				return err
 			}
+		}
+		err := tx.Bucket([]byte(chainstateBucket)).Put([]byte("version"), IntToHex(chainstateVersion))
+		if err != nil {
+			return err
+		}
+		err = bc.connectBlock(tx, genesis)
+		if err != nil {
+			return err
+		}
+		bc.utxo.applyBlock(tx, genesis)
+		return nil
+	})
+	if err != nil {
+		panic(err)
+	}
+	bc.tip = genesis.Hash
+
+	return bc
+}
+
+// connectBlock stores block, moves the tip to it and records its
+// transactions' confirmation in the fee estimates, all within tx.
+func (bc *Blockchain) connectBlock(tx *bolt.Tx, block *Block) error {
+	b := tx.Bucket([]byte(blocksBucket))
+
+	err := b.Put(block.Hash, block.Serialize())
+	if err != nil {
+		return err
+	}
+	err = b.Put([]byte("l"), block.Hash)
+	if err != nil {
+		return err
+	}
+
+	fe := loadFeeEstimator(tx)
+	fe.processBlock(block)
+	return fe.save(tx)
+}
+
+// ConnectBlock appends block, which must extend the tip, and then applies
+// it to the UTXO cache, which writes it out with later blocks.
+func (bc *Blockchain) ConnectBlock(block *Block) error {
+	if !bytes.Equal(block.PrevBlockHash, bc.tip) {
+		return fmt.Errorf("Block %x does not extend the tip %x", block.Hash, bc.tip)
+	}
+
+	err := bc.db.Update(func(tx *bolt.Tx) error {
+		return bc.connectBlock(tx, block)
+	})
+	if err != nil {
+		return err
+	}
+
+	bc.tip = block.Hash
+	bc.utxo.ApplyBlock(block)
+	return nil
+}
 
-			err = b.Put(genesis.Hash, genesis.Serialize())
+// DisconnectBlock removes the tip block from the main chain and then
+// restores the outputs it spent in the UTXO cache from its undo data.
+func (bc *Blockchain) DisconnectBlock(block *Block) error {
+	if !bytes.Equal(block.Hash, bc.tip) {
+		return fmt.Errorf("Block %x is not the tip %x", block.Hash, bc.tip)
+	}
+
+	undo, ok := bc.utxo.BlockUndo(block.Hash)
+	if !ok {
+		return fmt.Errorf("No undo data for block %x", block.Hash)
+	}
+
+	err := bc.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(blocksBucket)).Put([]byte("l"), block.PrevBlockHash)
+	})
+	if err != nil {
+		return err
+	}
+
+	bc.tip = block.PrevBlockHash
+	bc.utxo.DisconnectBlock(block, undo)
+	return nil
+}
+
+// reorganize makes newTip, whose ancestors must all be stored, the tip by
+// disconnecting the main chain back to the fork point and connecting the
+// new branch.
+func (bc *Blockchain) reorganize(newTip *Block) error {
+	var branch []*Block
+	var detach []*Block
 
+	newBlock := newTip
+	oldBlock, err := bc.GetBlock(bc.tip)
+	if err != nil {
+		return err
+	}
+	oldPtr := &oldBlock
+
+	for !bytes.Equal(newBlock.Hash, oldPtr.Hash) {
+		if newBlock.Height >= oldPtr.Height {
+			branch = append(branch, newBlock)
+			parent, err := bc.GetBlock(newBlock.PrevBlockHash)
+			if err != nil {
+				return err
+			}
+			newBlock = &parent
+		} else {
+			detach = append(detach, oldPtr)
+			parent, err := bc.GetBlock(oldPtr.PrevBlockHash)
 			if err != nil {
-				panic(err)
+				return err
 			}
+			oldPtr = &parent
+		}
+	}
 
-			err = b.Put([]byte("l"), genesis.Hash)
-			tip = genesis.Hash
+	fmt.Printf("Reorganizing: disconnecting %d blocks, connecting %d\n", len(detach), len(branch))
 
-		} else {
-			fmt.Printf("Using db blockchain\n")
-			tip = b.Get([]byte("l"))
+	for _, block := range detach {
+		err := bc.DisconnectBlock(block)
+		if err != nil {
+			return err
+		}
+	}
+	for i := len(branch) - 1; i >= 0; i-- {
+		if !bc.VerifyTransactions(branch[i].Transactions) {
+			return bc.restoreBranch(branch[i+1:], detach)
 		}
+		err := bc.ConnectBlock(branch[i])
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// restoreBranch undoes a failed reorganization: it disconnects the
+// connected blocks of the new branch and reconnects the old main chain.
+func (bc *Blockchain) restoreBranch(connected, detached []*Block) error {
+	for _, block := range connected {
+		err := bc.DisconnectBlock(block)
+		if err != nil {
+			return err
+		}
+	}
+	for i := len(detached) - 1; i >= 0; i-- {
+		err := bc.ConnectBlock(detached[i])
+		if err != nil {
+			return err
+		}
+	}
+	return errors.New("Reorganization aborted: new branch has invalid transactions")
+}
 
+// recoverChainstate checks that the UTXO set was built for the current
+// tip and repairs it if not, either by replaying the blocks it is missing
+// or, if it is not on the main chain, by reindexing.
+func (bc *Blockchain) recoverChainstate() {
+	var marker []byte
+	var reindexing bool
+	var version int64
+
+	err := bc.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(chainstateBucket))
+		if b != nil {
+			marker = append([]byte{}, b.Get([]byte("l"))...)
+			reindexing = b.Get([]byte("reindex")) != nil
+			if v := b.Get([]byte("version")); v != nil {
+				version = int64(binary.BigEndian.Uint64(v))
+			}
+		}
 		return nil
 	})
+	if err != nil {
+		panic(err)
+	}
+
+	if !reindexing && version < chainstateVersion {
+		fmt.Printf("UTXO set format is outdated, reindexing\n")
+		UTXOSet := UTXOSet{bc}
+		UTXOSet.ReIndex()
+		return
+	}
+
+	if !reindexing && bytes.Equal(marker, bc.tip) {
+		return
+	}
 
-	bc := Blockchain{tip, db}
-	return &bc
+	fmt.Printf("UTXO set is at %x but the tip is %x, repairing\n", marker, bc.tip)
+
+	if !reindexing && marker != nil {
+		var missing []*Block
+		bci := bc.Iterator()
+		for {
+			block := bci.Next()
+			if bytes.Equal(block.Hash, marker) {
+				for i := len(missing) - 1; i >= 0; i-- {
+					bc.utxo.ApplyBlock(missing[i])
+				}
+				bc.utxo.Flush()
+				return
+			}
+			missing = append(missing, block)
+			if len(block.PrevBlockHash) == 0 {
+				break
+			}
+		}
+	}
+
+	UTXOSet := UTXOSet{bc}
+	UTXOSet.ReIndex()
+}
+
+// Close flushes the UTXO cache and closes the db.
+func (bc *Blockchain) Close() {
+	bc.utxo.Flush()
+	bc.db.Close()
 }
 
 func (bc *Blockchain) FindTransaction(ID []byte) (Transaction, error) {
@@ -118,33 +328,220 @@ func (bc *Blockchain) FindTransaction(ID []byte) (Transaction, error) {
 	return Transaction{}, errors.New(fmt.Sprintf("Transaction not found: %s", hex.EncodeToString(ID)))
 }
 
-func (bc *Blockchain) SignTransaction(tx *Transaction, privKey ecdsa.PrivateKey) {
-	prevTXs := make(map[string]Transaction)
+// prevOutputs looks up the outputs spent by tx in the UTXO set, keyed by
+// the hex encoded outpoint.
+func (bc *Blockchain) prevOutputs(tx *Transaction) (map[string]TXOutput, error) {
+	prevOuts := make(map[string]TXOutput)
 	for _, vin := range tx.Vin {
-		prevTx, err := bc.FindTransaction(vin.Txid)
-		if err != nil {
-			panic(err)
+		outpoint := outpointKey(vin.Txid, vin.Vout)
+		coin, ok := bc.utxo.FetchCoin(outpoint)
+		if !ok {
+			return nil, fmt.Errorf("Output %x:%d is spent or does not exist", vin.Txid, vin.Vout)
 		}
-		prevTXs[hex.EncodeToString(prevTx.ID)] = prevTx
+		prevOuts[hex.EncodeToString(outpoint)] = coin.Output
 	}
+	return prevOuts, nil
+}
 
-	tx.Sign(privKey, prevTXs)
+// TransactionFee returns the amount by which the outputs tx spends exceed
+// the outputs it creates.
+func (bc *Blockchain) TransactionFee(tx *Transaction) int {
+	prevOuts, err := bc.prevOutputs(tx)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	fee := 0
+	for _, prevOut := range prevOuts {
+		fee += prevOut.Value
+	}
+	for _, out := range tx.Vout {
+		fee -= out.Value
+	}
+	return fee
+}
+
+func (bc *Blockchain) SignTransaction(tx *Transaction, wallet *Wallet) {
+	prevOuts, err := bc.prevOutputs(tx)
+	if err != nil {
+		panic(err)
+	}
+
+	tx.Sign(wallet, prevOuts)
 }
 
 func (bc *Blockchain) VerifyTransaction(tx *Transaction) bool {
-	if tx.IsCoinbase() {
-		return true
+	return bc.VerifyTransactions([]*Transaction{tx})
+}
+
+// VerifyTransactions checks that txs, in order, are final in the block
+// after the tip and only spend unspent outputs or outputs of earlier txs
+// in the list whose relative locks have passed, that no tx creates more
+// value than it spends and coinbases claim at most the subsidy and fees,
+// with no value or sum of values above maxMoney, and verifies all their
+// scripts in parallel.
+func (bc *Blockchain) VerifyTransactions(txs []*Transaction) bool {
+	var checks []scriptCheck
+	var fees, coinbaseValue int
+	created := make(map[string]Coin)
+	spent := make(map[string]bool)
+
+	tip, err := bc.GetBlock(bc.tip)
+	if err != nil {
+		log.Panic(err)
 	}
-	prevTXs := make(map[string]Transaction)
-	for _, vin := range tx.Vin {
-		prevTx, err := bc.FindTransaction(vin.Txid)
+	medianTime := bc.medianTimePast(bc.tip)
+
+	for _, tx := range txs {
+		if !tx.IsFinal(tip.Height+1, medianTime) {
+			log.Printf("Transaction %x is locked until %d", tx.ID, tx.LockTime)
+			return false
+		}
+
+		outValue := 0
+		for _, out := range tx.Vout {
+			if out.Value < 0 || out.Value > maxMoney {
+				log.Printf("Transaction %x has an output of %d", tx.ID, out.Value)
+				return false
+			}
+			outValue += out.Value
+			if outValue > maxMoney {
+				log.Printf("Transaction %x creates more than %d", tx.ID, maxMoney)
+				return false
+			}
+		}
+
+		if tx.IsCoinbase() {
+			coinbaseValue += outValue
+			if coinbaseValue > maxMoney {
+				log.Printf("Coinbases claim more than %d", maxMoney)
+				return false
+			}
+		} else {
+			prevOuts := make(map[string]TXOutput)
+			inValue := 0
+			var coinHeights []int
+			for _, vin := range tx.Vin {
+				outpoint := outpointKey(vin.Txid, vin.Vout)
+				key := hex.EncodeToString(outpoint)
+				if spent[key] {
+					log.Printf("Transaction %x double spends %x:%d", tx.ID, vin.Txid, vin.Vout)
+					return false
+				}
+
+				coin, ok := created[key]
+				if !ok {
+					coin, ok = bc.utxo.FetchCoin(outpoint)
+				}
+				if !ok {
+					log.Printf("Transaction %x spends missing output %x:%d", tx.ID, vin.Txid, vin.Vout)
+					return false
+				}
+				prevOuts[key] = coin.Output
+				inValue += coin.Output.Value
+				if inValue > maxMoney {
+					log.Printf("Transaction %x spends more than %d", tx.ID, maxMoney)
+					return false
+				}
+				coinHeights = append(coinHeights, coin.Height)
+				spent[key] = true
+			}
+			if !bc.sequenceLocksPassed(tx, coinHeights, tip.Height+1, medianTime) {
+				log.Printf("Transaction %x spends outputs that are still relatively locked", tx.ID)
+				return false
+			}
+			if inValue < outValue {
+				log.Printf("Transaction %x spends %d but creates %d", tx.ID, inValue, outValue)
+				return false
+			}
+			fees += inValue - outValue
+			if fees > maxMoney {
+				log.Printf("Transactions pay more than %d in fees", maxMoney)
+				return false
+			}
+			checks = append(checks, tx.scriptChecks(prevOuts)...)
+		}
+
+		for outIdx, out := range tx.Vout {
+			if out.IsUnspendable() {
+				if data, ok := extractNullData(out.ScriptPubKey); !ok || len(data) > maxDataCarrierSize {
+					log.Printf("Transaction %x has an invalid data output", tx.ID)
+					return false
+				}
+				continue
+			}
+			created[hex.EncodeToString(outpointKey(tx.ID, outIdx))] = Coin{out, tip.Height + 1}
+		}
+	}
+
+	if coinbaseValue > subsidy+fees {
+		log.Printf("Coinbase claims %d, more than the subsidy and fees of %d", coinbaseValue, subsidy+fees)
+		return false
+	}
+
+	return verifyScriptChecks(checks)
+}
+
+// medianTimePast returns the median timestamp of the block at hash and
+// the medianTimeSpan-1 blocks before it. Timelocks are checked against it
+// rather than the next block's own timestamp, which its miner picks.
+func (bc *Blockchain) medianTimePast(hash []byte) int64 {
+	var times []int64
+
+	for len(times) < medianTimeSpan && len(hash) > 0 {
+		block, err := bc.GetBlock(hash)
 		if err != nil {
-			panic(err)
+			log.Panic(err)
 		}
-		prevTXs[hex.EncodeToString(prevTx.ID)] = prevTx
+		times = append(times, block.Timestamp)
+		hash = block.PrevBlockHash
 	}
 
-	return tx.Verify(prevTXs)
+	sort.Slice(times, func(i, j int) bool { return times[i] < times[j] })
+	return times[len(times)/2]
+}
+
+// sequenceLocksPassed reports whether every input of tx, spending a coin
+// created at the matching entry of coinHeights, has waited out the
+// relative lock in its Sequence by a block at height whose median time
+// past is blockTime. Time locks count from the median time past of the
+// block before the coin's.
+func (bc *Blockchain) sequenceLocksPassed(tx *Transaction, coinHeights []int, height int, blockTime int64) bool {
+	for inID, vin := range tx.Vin {
+		if vin.Sequence&SequenceLockTimeDisableFlag != 0 {
+			continue
+		}
+		value := int64(vin.Sequence & SequenceLockTimeMask)
+
+		if vin.Sequence&SequenceLockTimeTypeFlag == 0 {
+			if coinHeights[inID]+int(value) > height {
+				return false
+			}
+			continue
+		}
+
+		prevHeight := coinHeights[inID] - 1
+		if prevHeight < 0 {
+			prevHeight = 0
+		}
+		coinTime := bc.medianTimePast(bc.mainChainHash(prevHeight))
+		if coinTime+value<<SequenceLockTimeGranularity > blockTime {
+			return false
+		}
+	}
+	return true
+}
+
+// mainChainHash returns the hash of the main chain block at height, which
+// must not be above the tip.
+func (bc *Blockchain) mainChainHash(height int) []byte {
+	bci := bc.Iterator()
+	for {
+		block := bci.Next()
+		if block.Height <= height {
+			return block.Hash
+		}
+	}
 }
 
 func (bc *Blockchain) GetBestHeight() int {
@@ -204,36 +601,45 @@ func (bc *Blockchain) GetBlock(blockHash []byte) (Block, error) {
 	return block, nil
 }
 
+// AddBlock stores a block received from a peer. A block extending the tip
+// is connected; one that makes a side branch longer than the main chain
+// triggers a reorganization onto it.
 func (bc *Blockchain) AddBlock(block *Block) {
-	err := bc.db.Update(func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte(blocksBucket))
-		blockInDb := b.Get(block.Hash)
+	var known bool
+	err := bc.db.View(func(tx *bolt.Tx) error {
+		known = tx.Bucket([]byte(blocksBucket)).Get(block.Hash) != nil
+		return nil
+	})
+	if err != nil {
+		log.Panic(err)
+	}
+	if known {
+		return
+	}
 
-		if blockInDb != nil {
-			return nil
+	if bytes.Equal(block.PrevBlockHash, bc.tip) {
+		if !bc.VerifyTransactions(block.Transactions) {
+			log.Printf("Rejected block %x with invalid transactions", block.Hash)
+			return
 		}
-
-		blockData := block.Serialize()
-		err := b.Put(block.Hash, blockData)
+		err := bc.ConnectBlock(block)
 		if err != nil {
 			log.Panic(err)
 		}
+		return
+	}
 
-		lastHash := b.Get([]byte("l"))
-		lastBlockData := b.Get(lastHash)
-		lastBlock := DeserializeBlock(lastBlockData)
-
-		if block.Height > lastBlock.Height {
-			err = b.Put([]byte("l"), block.Hash)
-			if err != nil {
-				log.Panic(err)
-			}
-			bc.tip = block.Hash
-		}
-
-		return nil
+	err = bc.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(blocksBucket)).Put(block.Hash, block.Serialize())
 	})
 	if err != nil {
 		log.Panic(err)
 	}
+
+	if block.Height > bc.GetBestHeight() {
+		err := bc.reorganize(block)
+		if err != nil {
+			log.Print(err)
+		}
+	}
 }
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bytes"
+	"crypto/elliptic"
+	"math"
+	"os"
+	"testing"
+
+	"github.com/boltdb/bolt"
+)
+
+// useTestDir changes to a temporary directory for the rest of the test,
+// where blockchains and wallets are created, and mines at a low
+// difficulty meanwhile.
+func useTestDir(t *testing.T) {
+	dir, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	bits := targetBits
+	targetBits = 8
+	t.Cleanup(func() {
+		targetBits = bits
+		os.Chdir(dir)
+	})
+}
+
+// newTestBlockchain creates, in a test directory, a wallet and a
+// blockchain whose genesis block pays to it, and returns the chain and
+// the wallet's address.
+func newTestBlockchain(t *testing.T) (*Blockchain, string) {
+	useTestDir(t)
+	address := newTestWallet(t)
+	bc := NewBlockChain(address)
+	t.Cleanup(bc.Close)
+	return bc, address
+}
+
+// newTestWallet adds a P-256 wallet to the wallet file and returns its
+// address.
+func newTestWallet(t *testing.T) string {
+	wallets, _ := NewWallets()
+	address := wallets.CreateWallet(elliptic.P256())
+	wallets.SaveToFile()
+	return address
+}
+
+func TestVerifyTransactionsValueOverflow(t *testing.T) {
+	bc, from := newTestBlockchain(t)
+	to := newTestWallet(t)
+	_, sign := walletSigner(from, bc)
+
+	tx := NewUTXOTransaction(from, to, 5, 0, 0, maxTxFee, false, BranchAndBound{}, bc)
+	if !bc.VerifyTransaction(tx) {
+		t.Fatal("valid transaction rejected")
+	}
+
+	withOutputs := func(outputs ...TXOutput) *Transaction {
+		spend := Transaction{nil, append([]TXInput{}, tx.Vin...), outputs, tx.LockTime}
+		spend.SetId()
+		sign(&spend)
+		return &spend
+	}
+
+	// Two outputs of math.MaxInt64 sum to -2, which is below the value
+	// spent and would leave a fee of 12 for the coinbase to claim.
+	overflow := withOutputs(*NewTXOutput(math.MaxInt64, to), *NewTXOutput(math.MaxInt64, to))
+	coinbase := NewCoinbaseTx(from, "", 12)
+	large := withOutputs(*NewTXOutput(maxMoney+1, to))
+	if !bc.VerifyTransaction(withOutputs(*NewTXOutput(10, to))) {
+		t.Fatal("valid re-signed transaction rejected")
+	}
+
+	tests := []struct {
+		name string
+		txs  []*Transaction
+	}{
+		{"overflowing outputs", []*Transaction{overflow}},
+		{"coinbase claiming overflowed fees", []*Transaction{coinbase, overflow}},
+		{"output above maxMoney", []*Transaction{large}},
+	}
+	for _, test := range tests {
+		if bc.VerifyTransactions(test.txs) {
+			t.Errorf("%s: transactions verified", test.name)
+		}
+	}
+}
+
+// chainstateMarker returns the block the flushed UTXO set was built for.
+func chainstateMarker(t *testing.T, bc *Blockchain) []byte {
+	var marker []byte
+	err := bc.db.View(func(tx *bolt.Tx) error {
+		marker = append([]byte{}, tx.Bucket([]byte(chainstateBucket)).Get([]byte("l"))...)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return marker
+}
+
+func TestConnectBlockRecoversAfterCrash(t *testing.T) {
+	useTestDir(t)
+	from := newTestWallet(t)
+	to := newTestWallet(t)
+	bc := NewBlockChain(from)
+	genesis := bc.tip
+
+	tx := NewUTXOTransaction(from, to, 5, 0, 0, maxTxFee, false, BranchAndBound{}, bc)
+	bc.MineBlock([]*Transaction{NewCoinbaseTx(from, "", bc.TransactionFee(tx)), tx})
+	bc.MineBlock([]*Transaction{NewCoinbaseTx(from, "", 0)})
+	tip := bc.tip
+
+	if marker := chainstateMarker(t, bc); !bytes.Equal(marker, genesis) {
+		t.Fatalf("UTXO set flushed at %x, want it left at genesis %x", marker, genesis)
+	}
+
+	// Closing the db without flushing the cache loses the UTXO changes
+	// of both blocks, as a crash would.
+	bc.db.Close()
+
+	bc = NewBlockChain(from)
+	defer bc.Close()
+
+	info := UTXOSet{bc}.Info()
+	if !bytes.Equal(info.BestBlock, tip) {
+		t.Errorf("UTXO set at %x after recovery, want the tip %x", info.BestBlock, tip)
+	}
+	if info.TotalAmount != 3*subsidy {
+		t.Errorf("UTXO set holds %d after recovery, want %d", info.TotalAmount, 3*subsidy)
+	}
+	if _, ok := bc.utxo.FetchCoin(outpointKey(tx.Vin[0].Txid, tx.Vin[0].Vout)); ok {
+		t.Error("coin spent before the crash is unspent after recovery")
+	}
+}
+
+func TestDisconnectBlockPendingUndo(t *testing.T) {
+	bc, from := newTestBlockchain(t)
+	to := newTestWallet(t)
+
+	tx := NewUTXOTransaction(from, to, 5, 0, 0, maxTxFee, false, BranchAndBound{}, bc)
+	spent := outpointKey(tx.Vin[0].Txid, tx.Vin[0].Vout)
+	block := bc.MineBlock([]*Transaction{NewCoinbaseTx(from, "", bc.TransactionFee(tx)), tx})
+
+	// The block's undo data has not been flushed yet.
+	if err := bc.DisconnectBlock(block); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := bc.utxo.FetchCoin(spent); !ok {
+		t.Error("coin spent by the disconnected block is not restored")
+	}
+
+	bc.utxo.Flush()
+	if _, ok := bc.utxo.BlockUndo(block.Hash); ok {
+		t.Error("undo data of the disconnected block was kept")
+	}
+	if marker := chainstateMarker(t, bc); !bytes.Equal(marker, bc.tip) {
+		t.Errorf("UTXO set flushed at %x, want the tip %x", marker, bc.tip)
+	}
+}
@@ -1,10 +1,18 @@
 package main
 
 import (
+	"crypto/elliptic"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"flag"
 	"fmt"
+	"log"
+	"math"
 	"os"
 	"strconv"
+	"strings"
+	"time"
 )
 
 type CLI struct {
@@ -12,9 +20,7 @@ type CLI struct {
 
 func (cli *CLI) createBlockchain(address string) {
 	bc := NewBlockChain(address)
-	UTXOSet := UTXOSet{bc}
-	UTXOSet.ReIndex()
-	bc.db.Close()
+	bc.Close()
 	fmt.Printf("Blockchain created.")
 }
 
@@ -22,12 +28,17 @@ func (cli *CLI) Run() {
 
 	cli.validateArgs()
 
-	addBlockCmd := flag.NewFlagSet("addblock", flag.ExitOnError)
-
 	printChainCmd := flag.NewFlagSet("printchain", flag.ExitOnError)
 	createWallet := flag.NewFlagSet("createwallet", flag.ExitOnError)
+	createWalletFile := createWallet.String("wallet", walletFile, "wallet file")
+	createWalletCurve := createWallet.String("curve", "p256", "curve of the key: p256 or secp256k1")
 
-	addBlockData := addBlockCmd.String("data", "", "Block data")
+	putData := flag.NewFlagSet("putdata", flag.ExitOnError)
+	putDataFrom := putData.String("from", "", "address paying for the transaction")
+	putDataData := putData.String("data", "", "data to store")
+	putDataFee := putData.Int("fee", 0, "fee to pay")
+	putDataFeeRate := putData.Int("feerate", 0, "fee to pay per 1000 bytes")
+	putDataMaxFee := putData.Int("maxfee", maxTxFee, "highest fee to pay")
 
 	createblockchain := flag.NewFlagSet("createblockchain", flag.ExitOnError)
 
@@ -36,14 +47,150 @@ func (cli *CLI) Run() {
 	getBalance := flag.NewFlagSet("getbalance", flag.ExitOnError)
 	balanceAddress := getBalance.String("address", "", "address for balance")
 
+	reindexUTXO := flag.NewFlagSet("reindexutxo", flag.ExitOnError)
+	getTxOutSetInfo := flag.NewFlagSet("gettxoutsetinfo", flag.ExitOnError)
+
+	createMultisig := flag.NewFlagSet("createmultisig", flag.ExitOnError)
+	multisigRequired := createMultisig.Int("m", 0, "signatures required")
+	multisigPubKeys := createMultisig.String("pubkeys", "", "comma separated hex public keys")
+	multisigWallet := createMultisig.String("wallet", walletFile, "wallet file to store the address in")
+
+	createMultisigTx := flag.NewFlagSet("createmultisigtx", flag.ExitOnError)
+	multisigTxFrom := createMultisigTx.String("from", "", "multisig address to spend from")
+	multisigTxTo := createMultisigTx.String("to", "", "address for to")
+	multisigTxAmount := createMultisigTx.Int("amount", 0, "amount to transfer")
+	multisigTxOut := createMultisigTx.String("out", "", "file to write the unsigned transaction to")
+	multisigTxFee := createMultisigTx.Int("fee", 0, "fee to pay")
+	multisigTxFeeRate := createMultisigTx.Int("feerate", 0, "fee to pay per 1000 bytes")
+	multisigTxMaxFee := createMultisigTx.Int("maxfee", maxTxFee, "highest fee to pay")
+	multisigTxWallet := createMultisigTx.String("wallet", walletFile, "wallet file holding the multisig address")
+
+	signMultisig := flag.NewFlagSet("signmultisig", flag.ExitOnError)
+	signMultisigIn := signMultisig.String("in", "", "transaction file")
+	signMultisigWallet := signMultisig.String("wallet", walletFile, "wallet file holding the signing keys")
+
+	finalizeMultisig := flag.NewFlagSet("finalizemultisig", flag.ExitOnError)
+	finalizeMultisigIn := finalizeMultisig.String("in", "", "transaction file")
+
+	createPSBT := flag.NewFlagSet("createpsbt", flag.ExitOnError)
+	psbtFrom := createPSBT.String("from", "", "address for from")
+	psbtTo := createPSBT.String("to", "", "address for to")
+	psbtAmount := createPSBT.Int("amount", 0, "amount to transfer")
+	psbtFee := createPSBT.Int("fee", 0, "fee to pay")
+	psbtFeeRate := createPSBT.Int("feerate", 0, "fee to pay per 1000 bytes")
+	psbtRBF := createPSBT.Bool("rbf", false, "allow the fee to be bumped later")
+	psbtCoinSelect := createPSBT.String("coinselect", "bnb", "coin selection: bnb, largest, smallest or random")
+	psbtMaxFee := createPSBT.Int("maxfee", maxTxFee, "highest fee to pay")
+	psbtSigHash := createPSBT.String("sighash", "ALL", "signature hash type: ALL, NONE or SINGLE, optionally with |ANYONECANPAY")
+	psbtOut := createPSBT.String("out", "", "file to write the unsigned transaction to")
+	psbtWallet := createPSBT.String("wallet", walletFile, "wallet file holding the redeem script of a script address")
+
+	signPSBT := flag.NewFlagSet("signpsbt", flag.ExitOnError)
+	signPSBTIn := signPSBT.String("in", "", "transaction file")
+	signPSBTWallet := signPSBT.String("wallet", walletFile, "wallet file holding the signing keys")
+
+	combinePSBT := flag.NewFlagSet("combinepsbt", flag.ExitOnError)
+	combinePSBTIn := combinePSBT.String("in", "", "comma separated transaction files")
+	combinePSBTOut := combinePSBT.String("out", "", "file to write the combined transaction to")
+
+	finalizePSBT := flag.NewFlagSet("finalizepsbt", flag.ExitOnError)
+	finalizePSBTIn := finalizePSBT.String("in", "", "transaction file")
+	finalizePSBTMempool := finalizePSBT.Bool("mempool", false, "add the transaction to the mempool instead of mining it")
+
+	createRawTx := flag.NewFlagSet("createrawtransaction", flag.ExitOnError)
+	rawTxInputs := createRawTx.String("inputs", "", `JSON array of {"txid", "vout"[, "sequence"]} outputs to spend`)
+	rawTxOutputs := createRawTx.String("outputs", "", `JSON array of {"address", "amount"} payments`)
+	rawTxLockTime := createRawTx.Uint("locktime", 0, "block height, or unix time if at least 500000000")
+	rawTxRBF := createRawTx.Bool("rbf", false, "allow the transaction to be replaced")
+
+	decodeRawTx := flag.NewFlagSet("decoderawtransaction", flag.ExitOnError)
+	decodeRawTxHex := decodeRawTx.String("hex", "", "hex transaction")
+
+	signRawTx := flag.NewFlagSet("signrawtransaction", flag.ExitOnError)
+	signRawTxHex := signRawTx.String("hex", "", "hex transaction")
+	signRawTxSigHash := signRawTx.String("sighash", "ALL", "signature hash type: ALL, NONE or SINGLE, optionally with |ANYONECANPAY")
+	signRawTxWallet := signRawTx.String("wallet", walletFile, "wallet file holding the signing keys")
+
+	sendRawTx := flag.NewFlagSet("sendrawtransaction", flag.ExitOnError)
+	sendRawTxHex := sendRawTx.String("hex", "", "hex transaction")
+
+	createTimeLock := flag.NewFlagSet("createtimelock", flag.ExitOnError)
+	timeLockAddress := createTimeLock.String("address", "", "address that can spend once unlocked")
+	timeLockUntil := createTimeLock.Int64("locktime", 0, "block height, or unix time if at least 500000000")
+	timeLockBlocks := createTimeLock.Int64("blocks", 0, "blocks to wait after each payment is mined")
+	timeLockSeconds := createTimeLock.Int64("seconds", 0, "seconds to wait after each payment is mined, in units of 512")
+	timeLockWallet := createTimeLock.String("wallet", walletFile, "wallet file to store the address in")
+
+	swapInitiate := flag.NewFlagSet("swap initiate", flag.ExitOnError)
+	swapInitiateFrom := swapInitiate.String("from", "", "address funding the contract")
+	swapInitiateTo := swapInitiate.String("to", "", "participant's address")
+	swapInitiateAmount := swapInitiate.Int("amount", 0, "amount to lock in the contract")
+	swapInitiateLockTime := swapInitiate.Int64("locktime", 0, "refund locktime (default 48 hours from now)")
+
+	swapParticipate := flag.NewFlagSet("swap participate", flag.ExitOnError)
+	swapParticipateFrom := swapParticipate.String("from", "", "address funding the contract")
+	swapParticipateTo := swapParticipate.String("to", "", "initiator's address")
+	swapParticipateAmount := swapParticipate.Int("amount", 0, "amount to lock in the contract")
+	swapParticipateSecretHash := swapParticipate.String("secrethash", "", "secret hash from the initiator's contract")
+	swapParticipateLockTime := swapParticipate.Int64("locktime", 0, "refund locktime (default 24 hours from now)")
+
+	swapRedeem := flag.NewFlagSet("swap redeem", flag.ExitOnError)
+	swapRedeemContract := swapRedeem.String("contract", "", "hex contract")
+	swapRedeemTxID := swapRedeem.String("txid", "", "contract transaction")
+	swapRedeemSecret := swapRedeem.String("secret", "", "hex secret")
+	swapRedeemFee := swapRedeem.Int("fee", 0, "fee to pay")
+	swapRedeemFeeRate := swapRedeem.Int("feerate", 0, "fee to pay per 1000 bytes")
+	swapRedeemMaxFee := swapRedeem.Int("maxfee", maxTxFee, "highest fee to pay")
+	swapRedeemWallet := swapRedeem.String("wallet", walletFile, "wallet file holding the recipient's key")
+
+	swapRefund := flag.NewFlagSet("swap refund", flag.ExitOnError)
+	swapRefundContract := swapRefund.String("contract", "", "hex contract")
+	swapRefundTxID := swapRefund.String("txid", "", "contract transaction")
+	swapRefundFee := swapRefund.Int("fee", 0, "fee to pay")
+	swapRefundFeeRate := swapRefund.Int("feerate", 0, "fee to pay per 1000 bytes")
+	swapRefundMaxFee := swapRefund.Int("maxfee", maxTxFee, "highest fee to pay")
+	swapRefundWallet := swapRefund.String("wallet", walletFile, "wallet file holding the refund key")
+
+	swapAudit := flag.NewFlagSet("swap audit", flag.ExitOnError)
+	swapAuditContract := swapAudit.String("contract", "", "hex contract")
+	swapAuditTxID := swapAudit.String("txid", "", "contract transaction")
+
+	estimateFee := flag.NewFlagSet("estimatefee", flag.ExitOnError)
+	estimateFeeBlocks := estimateFee.Int("blocks", 1, "blocks to confirm within")
+
 	send := flag.NewFlagSet("send", flag.ExitOnError)
 	sendFrom := send.String("from", "", "address for from")
 	sendTo := send.String("to", "", "address for to")
 	sendAmount := send.String("amount", "", "amount to transfer")
+	sendFee := send.Int("fee", 0, "fee to pay")
+	sendFeeRate := send.Int("feerate", 0, "fee to pay per 1000 bytes")
+	sendRBF := send.Bool("rbf", false, "allow the fee to be bumped later")
+	sendMempool := send.Bool("mempool", false, "add the transaction to the mempool instead of mining it")
+	sendCoinSelect := send.String("coinselect", "bnb", "coin selection: bnb, largest, smallest or random")
+	sendMaxFee := send.Int("maxfee", maxTxFee, "highest fee to pay")
+
+	sendMany := flag.NewFlagSet("sendmany", flag.ExitOnError)
+	sendManyFrom := sendMany.String("from", "", "address for from")
+	sendManyFile := sendMany.String("file", "", "CSV or JSON file of address,amount payments")
+	sendManyFee := sendMany.Int("fee", 0, "fee to pay per transaction")
+	sendManyFeeRate := sendMany.Int("feerate", 0, "fee to pay per 1000 bytes")
+	sendManyRBF := sendMany.Bool("rbf", false, "allow the fee to be bumped later")
+	sendManyMempool := sendMany.Bool("mempool", false, "add the transactions to the mempool instead of mining them")
+	sendManyCoinSelect := sendMany.String("coinselect", "bnb", "coin selection: bnb, largest, smallest or random")
+	sendManyMaxFee := sendMany.Int("maxfee", maxTxFee, "highest fee to pay per transaction")
+
+	mine := flag.NewFlagSet("mine", flag.ExitOnError)
+	mineAddress := mine.String("address", "", "address to pay the block reward to")
+
+	bumpFee := flag.NewFlagSet("bumpfee", flag.ExitOnError)
+	bumpFeeTxID := bumpFee.String("txid", "", "mempool transaction to replace")
+	bumpFeeFee := bumpFee.Int("fee", 0, "new fee to pay")
+	bumpFeeFeeRate := bumpFee.Int("feerate", 0, "new fee to pay per 1000 bytes")
+	bumpFeeMaxFee := bumpFee.Int("maxfee", maxTxFee, "highest fee to pay")
 
 	switch os.Args[1] {
-	case "addblock":
-		err := addBlockCmd.Parse(os.Args[2:])
+	case "putdata":
+		err := putData.Parse(os.Args[2:])
 		if err != nil {
 			panic(err)
 		}
@@ -73,18 +220,137 @@ func (cli *CLI) Run() {
 		if err != nil {
 			panic(err)
 		}
+	case "sendmany":
+		err := sendMany.Parse(os.Args[2:])
+		if err != nil {
+			panic(err)
+		}
+	case "estimatefee":
+		err := estimateFee.Parse(os.Args[2:])
+		if err != nil {
+			panic(err)
+		}
+	case "mine":
+		err := mine.Parse(os.Args[2:])
+		if err != nil {
+			panic(err)
+		}
+	case "bumpfee":
+		err := bumpFee.Parse(os.Args[2:])
+		if err != nil {
+			panic(err)
+		}
+	case "reindexutxo":
+		err := reindexUTXO.Parse(os.Args[2:])
+		if err != nil {
+			panic(err)
+		}
+	case "gettxoutsetinfo":
+		err := getTxOutSetInfo.Parse(os.Args[2:])
+		if err != nil {
+			panic(err)
+		}
+	case "createmultisig":
+		err := createMultisig.Parse(os.Args[2:])
+		if err != nil {
+			panic(err)
+		}
+	case "createmultisigtx":
+		err := createMultisigTx.Parse(os.Args[2:])
+		if err != nil {
+			panic(err)
+		}
+	case "signmultisig":
+		err := signMultisig.Parse(os.Args[2:])
+		if err != nil {
+			panic(err)
+		}
+	case "finalizemultisig":
+		err := finalizeMultisig.Parse(os.Args[2:])
+		if err != nil {
+			panic(err)
+		}
+	case "createpsbt":
+		err := createPSBT.Parse(os.Args[2:])
+		if err != nil {
+			panic(err)
+		}
+	case "signpsbt":
+		err := signPSBT.Parse(os.Args[2:])
+		if err != nil {
+			panic(err)
+		}
+	case "combinepsbt":
+		err := combinePSBT.Parse(os.Args[2:])
+		if err != nil {
+			panic(err)
+		}
+	case "finalizepsbt":
+		err := finalizePSBT.Parse(os.Args[2:])
+		if err != nil {
+			panic(err)
+		}
+	case "createrawtransaction":
+		err := createRawTx.Parse(os.Args[2:])
+		if err != nil {
+			panic(err)
+		}
+	case "decoderawtransaction":
+		err := decodeRawTx.Parse(os.Args[2:])
+		if err != nil {
+			panic(err)
+		}
+	case "signrawtransaction":
+		err := signRawTx.Parse(os.Args[2:])
+		if err != nil {
+			panic(err)
+		}
+	case "sendrawtransaction":
+		err := sendRawTx.Parse(os.Args[2:])
+		if err != nil {
+			panic(err)
+		}
+	case "createtimelock":
+		err := createTimeLock.Parse(os.Args[2:])
+		if err != nil {
+			panic(err)
+		}
+	case "swap":
+		if len(os.Args) < 3 {
+			cli.printUsage()
+			os.Exit(1)
+		}
+		var err error
+		switch os.Args[2] {
+		case "initiate":
+			err = swapInitiate.Parse(os.Args[3:])
+		case "participate":
+			err = swapParticipate.Parse(os.Args[3:])
+		case "redeem":
+			err = swapRedeem.Parse(os.Args[3:])
+		case "refund":
+			err = swapRefund.Parse(os.Args[3:])
+		case "audit":
+			err = swapAudit.Parse(os.Args[3:])
+		default:
+			cli.printUsage()
+			os.Exit(1)
+		}
+		if err != nil {
+			panic(err)
+		}
 
 	default:
 		cli.printUsage()
 		os.Exit(1)
 	}
 
-	if addBlockCmd.Parsed() {
-		if *addBlockData == "" {
-			addBlockCmd.Usage()
+	if putData.Parsed() {
+		if *putDataFrom == "" || *putDataData == "" || (*putDataFee > 0 && *putDataFeeRate > 0) {
+			putData.Usage()
 			os.Exit(1)
 		}
-		cli.addBlock(*addBlockData)
+		cli.putData(*putDataFrom, *putDataData, *putDataFee, *putDataFeeRate, *putDataMaxFee)
 	}
 
 	if printChainCmd.Parsed() {
@@ -106,7 +372,8 @@ func (cli *CLI) Run() {
 		cli.getBalance(*balanceAddress)
 	}
 	if send.Parsed() {
-		if *sendTo == "" || *sendFrom == "" || *sendAmount == "" {
+		selector, ok := coinSelectors[*sendCoinSelect]
+		if *sendTo == "" || *sendFrom == "" || *sendAmount == "" || (*sendFee > 0 && *sendFeeRate > 0) || !ok {
 			send.Usage()
 			os.Exit(1)
 		}
@@ -114,10 +381,185 @@ func (cli *CLI) Run() {
 		if err != nil {
 			panic(err)
 		}
-		cli.send(*sendFrom, *sendTo, amnt)
+		cli.send(*sendFrom, *sendTo, amnt, *sendFee, *sendFeeRate, *sendMaxFee, *sendRBF, *sendMempool, selector)
+	}
+	if sendMany.Parsed() {
+		selector, ok := coinSelectors[*sendManyCoinSelect]
+		if *sendManyFrom == "" || *sendManyFile == "" || (*sendManyFee > 0 && *sendManyFeeRate > 0) || !ok {
+			sendMany.Usage()
+			os.Exit(1)
+		}
+		cli.sendMany(*sendManyFrom, *sendManyFile, *sendManyFee, *sendManyFeeRate, *sendManyMaxFee, *sendManyRBF, *sendManyMempool, selector)
+	}
+	if mine.Parsed() {
+		if *mineAddress == "" {
+			mine.Usage()
+			os.Exit(1)
+		}
+		cli.mine(*mineAddress)
+	}
+	if bumpFee.Parsed() {
+		if *bumpFeeTxID == "" || (*bumpFeeFee > 0 && *bumpFeeFeeRate > 0) {
+			bumpFee.Usage()
+			os.Exit(1)
+		}
+		cli.bumpFee(*bumpFeeTxID, *bumpFeeFee, *bumpFeeFeeRate, *bumpFeeMaxFee)
+	}
+	if estimateFee.Parsed() {
+		if *estimateFeeBlocks < 1 || *estimateFeeBlocks > maxConfirmTarget {
+			estimateFee.Usage()
+			os.Exit(1)
+		}
+		cli.estimateFee(*estimateFeeBlocks)
 	}
 	if createWallet.Parsed() {
-		cli.createWallet()
+		curve, ok := curves[*createWalletCurve]
+		if !ok {
+			createWallet.Usage()
+			os.Exit(1)
+		}
+		cli.createWallet(curve, *createWalletFile)
+	}
+	if reindexUTXO.Parsed() {
+		cli.reindexUTXO()
+	}
+	if getTxOutSetInfo.Parsed() {
+		cli.getTxOutSetInfo()
+	}
+	if createMultisig.Parsed() {
+		if *multisigRequired == 0 || *multisigPubKeys == "" {
+			createMultisig.Usage()
+			os.Exit(1)
+		}
+		cli.createMultisig(*multisigRequired, strings.Split(*multisigPubKeys, ","), *multisigWallet)
+	}
+	if createMultisigTx.Parsed() {
+		if *multisigTxFrom == "" || *multisigTxTo == "" || *multisigTxAmount <= 0 || *multisigTxOut == "" || (*multisigTxFee > 0 && *multisigTxFeeRate > 0) {
+			createMultisigTx.Usage()
+			os.Exit(1)
+		}
+		cli.createMultisigTx(*multisigTxFrom, *multisigTxTo, *multisigTxAmount, *multisigTxFee, *multisigTxFeeRate, *multisigTxMaxFee, *multisigTxOut, *multisigTxWallet)
+	}
+	if signMultisig.Parsed() {
+		if *signMultisigIn == "" {
+			signMultisig.Usage()
+			os.Exit(1)
+		}
+		cli.signMultisig(*signMultisigIn, *signMultisigWallet)
+	}
+	if createPSBT.Parsed() {
+		selector, selectorOK := coinSelectors[*psbtCoinSelect]
+		hashType, hashTypeOK := sigHashTypes[*psbtSigHash]
+		if *psbtFrom == "" || *psbtTo == "" || *psbtAmount <= 0 || *psbtOut == "" || (*psbtFee > 0 && *psbtFeeRate > 0) || !selectorOK || !hashTypeOK {
+			createPSBT.Usage()
+			os.Exit(1)
+		}
+		cli.createPSBT(*psbtFrom, *psbtTo, *psbtAmount, *psbtFee, *psbtFeeRate, *psbtMaxFee, *psbtRBF, selector, hashType, *psbtOut, *psbtWallet)
+	}
+	if signPSBT.Parsed() {
+		if *signPSBTIn == "" {
+			signPSBT.Usage()
+			os.Exit(1)
+		}
+		cli.signPSBT(*signPSBTIn, *signPSBTWallet)
+	}
+	if combinePSBT.Parsed() {
+		if *combinePSBTIn == "" || *combinePSBTOut == "" {
+			combinePSBT.Usage()
+			os.Exit(1)
+		}
+		cli.combinePSBT(strings.Split(*combinePSBTIn, ","), *combinePSBTOut)
+	}
+	if finalizePSBT.Parsed() {
+		if *finalizePSBTIn == "" {
+			finalizePSBT.Usage()
+			os.Exit(1)
+		}
+		cli.finalizePSBT(*finalizePSBTIn, *finalizePSBTMempool)
+	}
+	if createRawTx.Parsed() {
+		if *rawTxInputs == "" || *rawTxOutputs == "" || *rawTxLockTime > math.MaxUint32 {
+			createRawTx.Usage()
+			os.Exit(1)
+		}
+		cli.createRawTransaction(*rawTxInputs, *rawTxOutputs, uint32(*rawTxLockTime), *rawTxRBF)
+	}
+	if decodeRawTx.Parsed() {
+		if *decodeRawTxHex == "" {
+			decodeRawTx.Usage()
+			os.Exit(1)
+		}
+		cli.decodeRawTransaction(*decodeRawTxHex)
+	}
+	if signRawTx.Parsed() {
+		hashType, ok := sigHashTypes[*signRawTxSigHash]
+		if *signRawTxHex == "" || !ok {
+			signRawTx.Usage()
+			os.Exit(1)
+		}
+		cli.signRawTransaction(*signRawTxHex, hashType, *signRawTxWallet)
+	}
+	if sendRawTx.Parsed() {
+		if *sendRawTxHex == "" {
+			sendRawTx.Usage()
+			os.Exit(1)
+		}
+		cli.sendRawTransaction(*sendRawTxHex)
+	}
+	if createTimeLock.Parsed() {
+		locks := 0
+		for _, lock := range []int64{*timeLockUntil, *timeLockBlocks, *timeLockSeconds} {
+			if lock > 0 {
+				locks++
+			}
+		}
+		if *timeLockAddress == "" || locks != 1 {
+			createTimeLock.Usage()
+			os.Exit(1)
+		}
+		cli.createTimeLock(*timeLockAddress, *timeLockUntil, *timeLockBlocks, *timeLockSeconds, *timeLockWallet)
+	}
+	if swapInitiate.Parsed() {
+		if *swapInitiateFrom == "" || *swapInitiateTo == "" || *swapInitiateAmount <= 0 {
+			swapInitiate.Usage()
+			os.Exit(1)
+		}
+		cli.swapInitiate(*swapInitiateFrom, *swapInitiateTo, *swapInitiateAmount, *swapInitiateLockTime)
+	}
+	if swapParticipate.Parsed() {
+		if *swapParticipateFrom == "" || *swapParticipateTo == "" || *swapParticipateAmount <= 0 || *swapParticipateSecretHash == "" {
+			swapParticipate.Usage()
+			os.Exit(1)
+		}
+		cli.swapParticipate(*swapParticipateFrom, *swapParticipateTo, *swapParticipateAmount, *swapParticipateSecretHash, *swapParticipateLockTime)
+	}
+	if swapRedeem.Parsed() {
+		if *swapRedeemContract == "" || *swapRedeemTxID == "" || *swapRedeemSecret == "" || (*swapRedeemFee > 0 && *swapRedeemFeeRate > 0) {
+			swapRedeem.Usage()
+			os.Exit(1)
+		}
+		cli.swapRedeem(*swapRedeemContract, *swapRedeemTxID, *swapRedeemSecret, *swapRedeemFee, *swapRedeemFeeRate, *swapRedeemMaxFee, *swapRedeemWallet)
+	}
+	if swapRefund.Parsed() {
+		if *swapRefundContract == "" || *swapRefundTxID == "" || (*swapRefundFee > 0 && *swapRefundFeeRate > 0) {
+			swapRefund.Usage()
+			os.Exit(1)
+		}
+		cli.swapRefund(*swapRefundContract, *swapRefundTxID, *swapRefundFee, *swapRefundFeeRate, *swapRefundMaxFee, *swapRefundWallet)
+	}
+	if swapAudit.Parsed() {
+		if *swapAuditContract == "" || *swapAuditTxID == "" {
+			swapAudit.Usage()
+			os.Exit(1)
+		}
+		cli.swapAudit(*swapAuditContract, *swapAuditTxID)
+	}
+	if finalizeMultisig.Parsed() {
+		if *finalizeMultisigIn == "" {
+			finalizeMultisig.Usage()
+			os.Exit(1)
+		}
+		cli.finalizeMultisig(*finalizeMultisigIn)
 	}
 
 }
@@ -126,22 +568,54 @@ func (cli *CLI) validateArgs() bool {
 	return true
 }
 func (cli *CLI) printUsage() {
-	fmt.Printf("addblock with -data\n")
+	fmt.Printf("putdata -from ADDRESS -data DATA [-fee FEE | -feerate RATE] [-maxfee FEE]\n")
 	fmt.Printf("printchain")
 	fmt.Printf("createchain -address ADDRESS")
+	fmt.Printf("send -from ADDRESS -to ADDRESS -amount AMOUNT [-fee FEE | -feerate RATE] [-maxfee FEE] [-rbf] [-mempool] [-coinselect STRATEGY]\n")
+	fmt.Printf("sendmany -from ADDRESS -file FILE [-fee FEE | -feerate RATE] [-maxfee FEE] [-rbf] [-mempool] [-coinselect STRATEGY]\n")
+	fmt.Printf("bumpfee -txid TXID [-fee FEE | -feerate RATE] [-maxfee FEE]\n")
+	fmt.Printf("mine -address ADDRESS\n")
+	fmt.Printf("estimatefee -blocks BLOCKS\n")
+	fmt.Printf("reindexutxo\n")
+	fmt.Printf("gettxoutsetinfo\n")
+	fmt.Printf("createwallet [-curve p256|secp256k1] [-wallet FILE]\n")
+	fmt.Printf("createmultisig -m M -pubkeys KEY,KEY,... [-wallet FILE]\n")
+	fmt.Printf("createmultisigtx -from MULTISIG -to ADDRESS -amount AMOUNT -out FILE [-fee FEE | -feerate RATE] [-maxfee FEE] [-wallet FILE]\n")
+	fmt.Printf("signmultisig -in FILE [-wallet FILE]\n")
+	fmt.Printf("finalizemultisig -in FILE\n")
+	fmt.Printf("createpsbt -from ADDRESS -to ADDRESS -amount AMOUNT -out FILE [-fee FEE | -feerate RATE] [-maxfee FEE] [-rbf] [-coinselect STRATEGY] [-sighash TYPE] [-wallet FILE]\n")
+	fmt.Printf("signpsbt -in FILE [-wallet FILE]\n")
+	fmt.Printf("combinepsbt -in FILE,FILE,... -out FILE\n")
+	fmt.Printf("finalizepsbt -in FILE [-mempool]\n")
+	fmt.Printf("createrawtransaction -inputs JSON -outputs JSON [-locktime LOCKTIME] [-rbf]\n")
+	fmt.Printf("decoderawtransaction -hex HEX\n")
+	fmt.Printf("signrawtransaction -hex HEX [-sighash TYPE] [-wallet FILE]\n")
+	fmt.Printf("sendrawtransaction -hex HEX\n")
+	fmt.Printf("swap initiate -from ADDRESS -to ADDRESS -amount AMOUNT [-locktime LOCKTIME]\n")
+	fmt.Printf("swap participate -from ADDRESS -to ADDRESS -amount AMOUNT -secrethash HASH [-locktime LOCKTIME]\n")
+	fmt.Printf("swap redeem -contract CONTRACT -txid TXID -secret SECRET [-fee FEE | -feerate RATE] [-maxfee FEE] [-wallet FILE]\n")
+	fmt.Printf("swap refund -contract CONTRACT -txid TXID [-fee FEE | -feerate RATE] [-maxfee FEE] [-wallet FILE]\n")
+	fmt.Printf("swap audit -contract CONTRACT -txid TXID\n")
+	fmt.Printf("createtimelock -address ADDRESS -locktime LOCKTIME | -blocks BLOCKS | -seconds SECONDS [-wallet FILE]\n")
 }
 
-func (cli *CLI) addBlock(data string) {
+func (cli *CLI) putData(from, data string, fee, feeRate, maxFee int) {
+	bc := NewBlockChain(from)
+	defer bc.Close()
+
+	tx := NewDataTransaction(from, []byte(data), fee, feeRate, maxFee, bc)
 
-	// cli.bc.AddBlock(data)
-	fmt.Println("Success")
+	cbTx := NewCoinbaseTx(from, "", bc.TransactionFee(tx))
+
+	bc.MineBlock([]*Transaction{cbTx, tx})
 
+	fmt.Printf("Stored in transaction %x\n", tx.ID)
 }
 
 func (cli *CLI) printChain() {
 
 	bc := NewBlockChain("")
-	defer bc.db.Close()
+	defer bc.Close()
 	bci := bc.Iterator()
 
 	for {
@@ -158,6 +632,10 @@ func (cli *CLI) printChain() {
 		for _, tx := range block.Transactions {
 			fmt.Printf("\tID:%x\n", tx.ID)
 			for _, vout := range tx.Vout {
+				if data, ok := extractNullData(vout.ScriptPubKey); ok {
+					fmt.Printf("\t>Data: %q\n", data)
+					continue
+				}
 				fmt.Printf("\t>Value: %d\n", vout.Value)
 			}
 			fmt.Println()
@@ -175,7 +653,7 @@ func (cli *CLI) getBalance(address string) {
 
 	bc := NewBlockChain(address)
 
-	defer bc.db.Close()
+	defer bc.Close()
 
 	balance := 0
 
@@ -194,26 +672,525 @@ func (cli *CLI) getBalance(address string) {
 
 }
 
-func (cli *CLI) send(from, to string, amount int) {
+func (cli *CLI) send(from, to string, amount, fee, feeRate, maxFee int, replaceable, toMempool bool, selector CoinSelector) {
 	bc := NewBlockChain(from)
-	defer bc.db.Close()
+	defer bc.Close()
+
+	tx := NewUTXOTransaction(from, to, amount, fee, feeRate, maxFee, replaceable, selector, bc)
+	fee = bc.TransactionFee(tx)
+
+	if toMempool {
+		mp := LoadMempool(bc)
+		err := mp.Accept(bc, tx)
+		if err != nil {
+			log.Panic(err)
+		}
+		mp.Save(bc)
 
-	tx := NewUTXOTransaction(from, to, amount, bc)
+		fmt.Printf("Transaction %x paying a fee of %d added to the mempool\n", tx.ID, fee)
+		return
+	}
 
-	cbTx := NewCoinbaseTx(from, "")
+	cbTx := NewCoinbaseTx(from, "", fee)
 
-	newBlock := bc.MineBlock([]*Transaction{cbTx, tx})
+	bc.MineBlock([]*Transaction{cbTx, tx})
 
-	UTXOSet := UTXOSet{bc}
-	UTXOSet.Update(newBlock)
+	fmt.Printf("Paid a fee of %d for %d bytes\n", fee, tx.Size())
+	fmt.Println("Success")
+
+}
+
+func (cli *CLI) sendMany(from, file string, fee, feeRate, maxFee int, replaceable, toMempool bool, selector CoinSelector) {
+	payments := LoadPayments(file)
+
+	bc := NewBlockChain(from)
+	defer bc.Close()
+
+	txs := NewBatchTransactions(from, payments, fee, feeRate, maxFee, replaceable, selector, bc)
+
+	if toMempool {
+		mp := LoadMempool(bc)
+		for _, tx := range txs {
+			err := mp.Accept(bc, tx)
+			if err != nil {
+				log.Panic(err)
+			}
+			fmt.Printf("Transaction %x with %d outputs added to the mempool\n", tx.ID, len(tx.Vout))
+		}
+		mp.Save(bc)
+		return
+	}
+
+	fees := 0
+	for _, tx := range txs {
+		fees += bc.TransactionFee(tx)
+	}
+	cbTx := NewCoinbaseTx(from, "", fees)
+
+	bc.MineBlock(append([]*Transaction{cbTx}, txs...))
 
+	fmt.Printf("Made %d payments in %d transactions, paying a fee of %d\n", len(payments), len(txs), fees)
 	fmt.Println("Success")
+}
+
+func (cli *CLI) estimateFee(blocks int) {
+	bc := NewBlockChain("")
+	defer bc.Close()
+
+	fmt.Printf("Fee rate to confirm within %d blocks: %d per %d bytes\n", blocks, bc.EstimateFee(blocks), feeRateSize)
+}
+
+func (cli *CLI) mine(address string) {
+	bc := NewBlockChain(address)
+	defer bc.Close()
+
+	mp := LoadMempool(bc)
+	txs, fees := mp.BlockTemplate(bc)
+	cbTx := NewCoinbaseTx(address, "", fees)
+
+	block := bc.MineBlock(append([]*Transaction{cbTx}, txs...))
+	mp.RemoveBlock(bc, block)
+	mp.Save(bc)
+
+	fmt.Printf("Mined block %x with %d transactions paying %d in fees\n", block.Hash, len(txs), fees)
+}
+
+func (cli *CLI) bumpFee(txID string, fee, feeRate, maxFee int) {
+	bc := NewBlockChain("")
+	defer bc.Close()
+
+	mp := LoadMempool(bc)
+	orig, ok := mp[txID]
+	if !ok {
+		log.Panicf("ERROR: Transaction %s is not in the mempool", txID)
+	}
+
+	tx := NewBumpFeeTransaction(&orig, fee, feeRate, maxFee, mp, bc)
+	fee = mp.Fee(bc, tx)
+	err := mp.Accept(bc, tx)
+	if err != nil {
+		log.Panic(err)
+	}
+	mp.Save(bc)
+
+	fmt.Printf("Replaced %s with %x paying a fee of %d\n", txID, tx.ID, fee)
+}
+
+func (cli *CLI) reindexUTXO() {
+	bc := NewBlockChain("")
+	defer bc.Close()
+
+	UTXOSet := UTXOSet{bc}
+	UTXOSet.ReIndex()
 
+	fmt.Println("Done!")
 }
 
-func (cli *CLI) createWallet() {
-	wallets, _ := NewWallets()
-	address := wallets.CreateWallet()
+func (cli *CLI) getTxOutSetInfo() {
+	bc := NewBlockChain("")
+	defer bc.Close()
+
+	UTXOSet := UTXOSet{bc}
+	info := UTXOSet.Info()
+
+	fmt.Printf("Height: %d\n", info.Height)
+	fmt.Printf("Best block: %x\n", info.BestBlock)
+	fmt.Printf("Transactions: %d\n", info.Transactions)
+	fmt.Printf("Outputs: %d\n", info.TxOuts)
+	fmt.Printf("Serialized size: %d bytes\n", info.SerializedSize)
+	fmt.Printf("Hash: %x\n", info.Hash)
+	fmt.Printf("Total amount: %d\n", info.TotalAmount)
+	fmt.Printf("Issued by subsidy: %d\n", subsidy*(info.Height+1))
+}
+
+func (cli *CLI) createWallet(curve elliptic.Curve, file string) {
+	wallets, _ := LoadWallets(file)
+	address := wallets.CreateWallet(curve)
 	wallets.SaveToFile()
 	fmt.Printf("Your wallet address is: %s\n", address)
+	fmt.Printf("Public key: %x\n", wallets.GetWallet(address).PublicKey)
+}
+
+func (cli *CLI) createMultisig(m int, hexKeys []string, file string) {
+	var pubKeys [][]byte
+	for _, hexKey := range hexKeys {
+		pubKey, err := hex.DecodeString(hexKey)
+		if err != nil {
+			log.Panic(err)
+		}
+		if _, err := parsePubKey(pubKey); err != nil {
+			log.Panic(err)
+		}
+		pubKeys = append(pubKeys, pubKey)
+	}
+
+	wallets, _ := LoadWallets(file)
+	address := wallets.AddMultisig(m, pubKeys)
+	wallets.SaveToFile()
+
+	fmt.Printf("Multisig address: %s\n", address)
+	fmt.Printf("Redeem script: %x\n", wallets.Scripts[address])
+}
+
+func (cli *CLI) createMultisigTx(from, to string, amount, fee, feeRate, maxFee int, out, file string) {
+	wallets, _ := LoadWallets(file)
+	redeemScript, ok := wallets.Scripts[from]
+	if !ok {
+		log.Panicf("ERROR: %s is not a multisig address in %s", from, file)
+	}
+
+	bc := NewBlockChain(from)
+	defer bc.Close()
+
+	mtx := NewMultisigTransaction(from, to, amount, fee, feeRate, maxFee, redeemScript, bc)
+	mtx.SaveToFile(out)
+
+	fmt.Printf("Transaction %x written to %s\n", mtx.Transaction.ID, out)
+}
+
+func (cli *CLI) signMultisig(in, file string) {
+	wallets, _ := LoadWallets(file)
+
+	mtx := LoadMultisigTx(in)
+	signed := mtx.Sign(wallets)
+	mtx.SaveToFile(in)
+
+	fmt.Printf("Signed with %d keys\n", signed)
+}
+
+func (cli *CLI) finalizeMultisig(in string) {
+	mtx := LoadMultisigTx(in)
+	tx, err := mtx.Finalize()
+	if err != nil {
+		log.Panic(err)
+	}
+
+	from := string(ScriptAddress(mtx.RedeemScript))
+	bc := NewBlockChain(from)
+	defer bc.Close()
+
+	if !bc.VerifyTransaction(tx) {
+		log.Panic("ERROR: Invalid transaction")
+	}
+
+	cbTx := NewCoinbaseTx(from, "", bc.TransactionFee(tx))
+
+	bc.MineBlock([]*Transaction{cbTx, tx})
+
+	fmt.Println("Success")
+}
+
+func (cli *CLI) createPSBT(from, to string, amount, fee, feeRate, maxFee int, replaceable bool, selector CoinSelector, hashType byte, out, file string) {
+	wallets, _ := LoadWallets(file)
+
+	bc := NewBlockChain(from)
+	defer bc.Close()
+
+	psbt := NewPartiallySignedTx(from, to, amount, fee, feeRate, maxFee, replaceable, selector, hashType, wallets.Scripts[from], bc)
+	psbt.SaveToFile(out)
+
+	fmt.Printf("Transaction %x written to %s\n", psbt.Transaction.ID, out)
+}
+
+func (cli *CLI) signPSBT(in, file string) {
+	wallets, _ := LoadWallets(file)
+
+	psbt := LoadPartiallySignedTx(in)
+	signed := psbt.Sign(wallets)
+	psbt.SaveToFile(in)
+
+	fmt.Printf("Added %d signatures\n", signed)
+}
+
+func (cli *CLI) combinePSBT(in []string, out string) {
+	psbt := LoadPartiallySignedTx(in[0])
+	for _, file := range in[1:] {
+		err := psbt.Combine(LoadPartiallySignedTx(file))
+		if err != nil {
+			log.Panic(err)
+		}
+	}
+	psbt.SaveToFile(out)
+
+	fmt.Printf("Transaction %x written to %s\n", psbt.Transaction.ID, out)
+}
+
+func (cli *CLI) finalizePSBT(in string, toMempool bool) {
+	psbt := LoadPartiallySignedTx(in)
+	tx, err := psbt.Finalize()
+	if err != nil {
+		log.Panic(err)
+	}
+
+	bc := NewBlockChain("")
+	defer bc.Close()
+
+	if toMempool {
+		mp := LoadMempool(bc)
+		err := mp.Accept(bc, tx)
+		if err != nil {
+			log.Panic(err)
+		}
+		mp.Save(bc)
+
+		fmt.Printf("Transaction %x added to the mempool\n", tx.ID)
+		return
+	}
+
+	if !bc.VerifyTransaction(tx) {
+		log.Panic("ERROR: Invalid transaction")
+	}
+
+	// The block reward goes to the address the transaction spends from.
+	prevOut := psbt.Inputs[0].PrevOut
+	addrVersion := byte(version)
+	if isPayToScriptHash(prevOut.LockingScript()) {
+		addrVersion = scriptVersion
+	}
+	from := string(encodeAddress(addrVersion, prevOut.AddressHash()))
+
+	cbTx := NewCoinbaseTx(from, "", bc.TransactionFee(tx))
+
+	bc.MineBlock([]*Transaction{cbTx, tx})
+
+	fmt.Println("Success")
+}
+
+func (cli *CLI) createRawTransaction(inputsJSON, outputsJSON string, lockTime uint32, replaceable bool) {
+	var inputs []RawTxInput
+	err := json.Unmarshal([]byte(inputsJSON), &inputs)
+	if err != nil {
+		log.Panic(err)
+	}
+	var payments []Payment
+	err = json.Unmarshal([]byte(outputsJSON), &payments)
+	if err != nil {
+		log.Panic(err)
+	}
+	for _, payment := range payments {
+		if !ValidateAddress(payment.Address) {
+			log.Panicf("ERROR: Invalid address %q", payment.Address)
+		}
+	}
+
+	tx := NewRawTransaction(inputs, payments, lockTime, replaceable)
+
+	fmt.Printf("%x\n", tx.Serialize())
+}
+
+func (cli *CLI) decodeRawTransaction(rawTx string) {
+	tx := DecodeRawTransaction(rawTx)
+
+	decoded, err := json.MarshalIndent(DecodeTransaction(tx), "", "  ")
+	if err != nil {
+		log.Panic(err)
+	}
+	fmt.Println(string(decoded))
+}
+
+func (cli *CLI) signRawTransaction(rawTx string, hashType byte, file string) {
+	wallets, _ := LoadWallets(file)
+	tx := DecodeRawTransaction(rawTx)
+
+	bc := NewBlockChain("")
+	defer bc.Close()
+
+	prevOuts, err := LoadMempool(bc).PrevOutputs(bc, tx)
+	if err != nil {
+		log.Panic(err)
+	}
+	complete := SignRawTransaction(tx, wallets, hashType, prevOuts)
+
+	result, err := json.MarshalIndent(struct {
+		Hex      string `json:"hex"`
+		Complete bool   `json:"complete"`
+	}{hex.EncodeToString(tx.Serialize()), complete}, "", "  ")
+	if err != nil {
+		log.Panic(err)
+	}
+	fmt.Println(string(result))
+}
+
+func (cli *CLI) sendRawTransaction(rawTx string) {
+	tx := DecodeRawTransaction(rawTx)
+
+	bc := NewBlockChain("")
+	defer bc.Close()
+
+	mp := LoadMempool(bc)
+	err := mp.Accept(bc, tx)
+	if err != nil {
+		log.Panic(err)
+	}
+	mp.Save(bc)
+
+	// Relay it to the central node, which announces it to the others.
+	sendTx(knownNodes[0], tx)
+
+	fmt.Printf("%x\n", tx.ID)
+}
+
+func (cli *CLI) createTimeLock(address string, lockTime, blocks, seconds int64, file string) {
+	op := byte(OP_CHECKLOCKTIMEVERIFY)
+	lock := lockTime
+	if blocks > 0 || seconds > 0 {
+		op = OP_CHECKSEQUENCEVERIFY
+		lock = blocks
+		if seconds > 0 {
+			lock = (seconds + 1<<SequenceLockTimeGranularity - 1) >> SequenceLockTimeGranularity
+		}
+		if lock > SequenceLockTimeMask {
+			log.Panic("ERROR: Relative lock is too long")
+		}
+		if seconds > 0 {
+			lock |= SequenceLockTimeTypeFlag
+		}
+	}
+
+	wallets, _ := LoadWallets(file)
+	scriptAddress := wallets.AddTimeLock(address, op, lock)
+	wallets.SaveToFile()
+
+	fmt.Printf("Timelocked address: %s\n", scriptAddress)
+	fmt.Printf("Redeem script: %x\n", wallets.Scripts[scriptAddress])
+}
+
+func (cli *CLI) swapInitiate(from, to string, amount int, lockTime int64) {
+	if lockTime == 0 {
+		lockTime = time.Now().Unix() + initiatorLockDuration
+	}
+	secret, secretHash := NewSwapSecret()
+
+	cli.swapContract(from, to, amount, secretHash, lockTime)
+	fmt.Printf("Secret: %x\n", secret)
+}
+
+func (cli *CLI) swapParticipate(from, to string, amount int, hexSecretHash string, lockTime int64) {
+	if lockTime == 0 {
+		lockTime = time.Now().Unix() + participantLockDuration
+	}
+	secretHash, err := hex.DecodeString(hexSecretHash)
+	if err != nil || len(secretHash) != sha256.Size {
+		log.Panic("ERROR: Invalid secret hash")
+	}
+
+	cli.swapContract(from, to, amount, secretHash, lockTime)
+}
+
+func (cli *CLI) swapContract(from, to string, amount int, secretHash []byte, lockTime int64) {
+	bc := NewBlockChain(from)
+	defer bc.Close()
+
+	contract, tx := NewSwapContract(from, to, amount, secretHash, lockTime, bc)
+
+	cbTx := NewCoinbaseTx(from, "", bc.TransactionFee(tx))
+
+	bc.MineBlock([]*Transaction{cbTx, tx})
+
+	fmt.Printf("Contract address: %s\n", ScriptAddress(contract))
+	fmt.Printf("Contract: %x\n", contract)
+	fmt.Printf("Contract transaction: %x\n", tx.ID)
+	fmt.Printf("Secret hash: %x\n", secretHash)
+	fmt.Printf("Locktime: %d\n", lockTime)
+}
+
+// swapSpend mines tx, which spends a swap contract, rewarding the address
+// it pays to.
+func (cli *CLI) swapSpend(bc *Blockchain, tx *Transaction) {
+	if !bc.VerifyTransaction(tx) {
+		log.Panic("ERROR: Invalid transaction")
+	}
+
+	to := encodeAddress(version, tx.Vout[0].AddressHash())
+	cbTx := NewCoinbaseTx(string(to), "", bc.TransactionFee(tx))
+
+	bc.MineBlock([]*Transaction{cbTx, tx})
+
+	fmt.Printf("Transaction %x paid %d to %s\n", tx.ID, tx.Vout[0].Value, to)
+}
+
+func (cli *CLI) findSwapContract(bc *Blockchain, hexContract, hexTxID string) ([]byte, *Transaction) {
+	contract, err := hex.DecodeString(hexContract)
+	if err != nil {
+		log.Panic(err)
+	}
+	txID, err := hex.DecodeString(hexTxID)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	tx, err := bc.FindTransaction(txID)
+	if err != nil {
+		log.Panic(err)
+	}
+	return contract, &tx
+}
+
+func (cli *CLI) swapRedeem(hexContract, hexTxID, hexSecret string, fee, feeRate, maxFee int, file string) {
+	bc := NewBlockChain("")
+	defer bc.Close()
+
+	contract, contractTx := cli.findSwapContract(bc, hexContract, hexTxID)
+	secret, err := hex.DecodeString(hexSecret)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	wallets, _ := LoadWallets(file)
+
+	cli.swapSpend(bc, NewSwapRedeemTransaction(contract, contractTx, secret, fee, feeRate, maxFee, wallets))
+}
+
+func (cli *CLI) swapRefund(hexContract, hexTxID string, fee, feeRate, maxFee int, file string) {
+	bc := NewBlockChain("")
+	defer bc.Close()
+
+	contract, contractTx := cli.findSwapContract(bc, hexContract, hexTxID)
+
+	wallets, _ := LoadWallets(file)
+
+	cli.swapSpend(bc, NewSwapRefundTransaction(contract, contractTx, fee, feeRate, maxFee, wallets))
+}
+
+func (cli *CLI) swapAudit(hexContract, hexTxID string) {
+	bc := NewBlockChain("")
+	defer bc.Close()
+
+	contract, contractTx := cli.findSwapContract(bc, hexContract, hexTxID)
+	terms, ok := extractAtomicSwapScript(contract)
+	if !ok {
+		log.Panic("ERROR: Not an atomic swap contract")
+	}
+	outIdx, ok := contractOutput(contractTx, contract)
+	if !ok {
+		log.Panicf("ERROR: Transaction %x does not pay to the contract", contractTx.ID)
+	}
+
+	fmt.Printf("Contract address: %s\n", ScriptAddress(contract))
+	fmt.Printf("Contract value: %d\n", contractTx.Vout[outIdx].Value)
+	fmt.Printf("Recipient address: %s\n", encodeAddress(version, terms.RecipientHash))
+	fmt.Printf("Refund address: %s\n", encodeAddress(version, terms.RefundHash))
+	fmt.Printf("Secret hash: %x\n", terms.SecretHash)
+	if terms.LockTime < LockTimeThreshold {
+		fmt.Printf("Locktime: block %d\n", terms.LockTime)
+	} else {
+		fmt.Printf("Locktime: %s\n", time.Unix(terms.LockTime, 0))
+	}
+
+	if _, unspent := bc.utxo.FetchCoin(outpointKey(contractTx.ID, outIdx)); unspent {
+		fmt.Println("Status: unspent")
+		return
+	}
+
+	spendTx, inID, found := bc.FindSpendingTransaction(contractTx.ID, outIdx)
+	if !found {
+		fmt.Println("Status: spent")
+		return
+	}
+	if secret, ok := extractSwapSecret(spendTx, inID, contract); ok {
+		fmt.Printf("Status: redeemed by %x\n", spendTx.ID)
+		fmt.Printf("Secret: %x\n", secret)
+		return
+	}
+	fmt.Printf("Status: refunded by %x\n", spendTx.ID)
 }
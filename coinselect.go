@@ -0,0 +1,199 @@
+package main
+
+import (
+	"encoding/hex"
+	"log"
+	"math/rand"
+	"sort"
+	"time"
+)
+
+// Approximate serialized sizes used to price spending and creating
+// outputs when choosing coins.
+const inputSize = 180
+const outputSize = 65
+
+// bnbMaxTries bounds the search of BranchAndBound.
+const bnbMaxTries = 100000
+
+// SpendableCoin is an unspent output a wallet can spend.
+type SpendableCoin struct {
+	Txid  []byte
+	Vout  int
+	Value int
+}
+
+// CoinSelector chooses which coins pay for a transaction.
+type CoinSelector interface {
+	// SelectCoins returns coins from candidates worth at least target, or
+	// false if they are not worth enough. Selections worth no more than
+	// target+costOfChange are best, as they need no change output.
+	SelectCoins(candidates []SpendableCoin, target, costOfChange int) ([]SpendableCoin, bool)
+}
+
+var coinRand = rand.New(rand.NewSource(time.Now().UnixNano()))
+
+var coinSelectors = map[string]CoinSelector{
+	"bnb":      BranchAndBound{},
+	"largest":  LargestFirst{},
+	"smallest": SmallestFirst{},
+	"random":   RandomSelection{},
+}
+
+// isDust reports whether an output worth value costs more to create and
+// later spend than it is worth, at feeRate or at dustRelayFeeRate if that
+// is higher, so that no output the wallet makes is dust to the relay.
+func isDust(value, feeRate int) bool {
+	if feeRate < dustRelayFeeRate {
+		feeRate = dustRelayFeeRate
+	}
+	return value*feeRateSize < feeRate*(inputSize+outputSize)
+}
+
+// changeCost returns the cost at feeRate of creating a change output and
+// later spending it.
+func changeCost(feeRate int) int {
+	return feeRate * (inputSize + outputSize) / feeRateSize
+}
+
+// accumulate takes coins in order until they are worth target.
+func accumulate(coins []SpendableCoin, target int) ([]SpendableCoin, bool) {
+	var selected []SpendableCoin
+	value := 0
+	for _, coin := range coins {
+		if value >= target {
+			break
+		}
+		selected = append(selected, coin)
+		value += coin.Value
+	}
+	return selected, value >= target
+}
+
+// LargestFirst spends the fewest, largest coins.
+type LargestFirst struct{}
+
+func (LargestFirst) SelectCoins(candidates []SpendableCoin, target, costOfChange int) ([]SpendableCoin, bool) {
+	coins := append([]SpendableCoin{}, candidates...)
+	sort.Slice(coins, func(i, j int) bool { return coins[i].Value > coins[j].Value })
+	return accumulate(coins, target)
+}
+
+// SmallestFirst consolidates the wallet by spending its smallest coins.
+type SmallestFirst struct{}
+
+func (SmallestFirst) SelectCoins(candidates []SpendableCoin, target, costOfChange int) ([]SpendableCoin, bool) {
+	coins := append([]SpendableCoin{}, candidates...)
+	sort.Slice(coins, func(i, j int) bool { return coins[i].Value < coins[j].Value })
+	return accumulate(coins, target)
+}
+
+// RandomSelection spends coins in random order, which avoids linking a
+// wallet's payments by the way it picks coins.
+type RandomSelection struct{}
+
+func (RandomSelection) SelectCoins(candidates []SpendableCoin, target, costOfChange int) ([]SpendableCoin, bool) {
+	coins := append([]SpendableCoin{}, candidates...)
+	coinRand.Shuffle(len(coins), func(i, j int) { coins[i], coins[j] = coins[j], coins[i] })
+	return accumulate(coins, target)
+}
+
+// BranchAndBound searches for the coins that pay target with the least
+// excess, up to costOfChange, so the transaction needs no change. Without
+// such a selection it spends the largest coins first.
+type BranchAndBound struct{}
+
+func (BranchAndBound) SelectCoins(candidates []SpendableCoin, target, costOfChange int) ([]SpendableCoin, bool) {
+	coins := append([]SpendableCoin{}, candidates...)
+	sort.Slice(coins, func(i, j int) bool { return coins[i].Value > coins[j].Value })
+
+	remaining := 0
+	for _, coin := range coins {
+		remaining += coin.Value
+	}
+
+	var best []bool
+	bestExcess := costOfChange + 1
+	included := make([]bool, len(coins))
+	tries := 0
+
+	// search decides whether to include coins[i] with value selected so
+	// far and remaining left in coins[i:].
+	var search func(i, value, remaining int)
+	search = func(i, value, remaining int) {
+		tries++
+		if tries > bnbMaxTries || value+remaining < target || value-target >= bestExcess {
+			return
+		}
+		if value >= target {
+			best = append([]bool{}, included...)
+			bestExcess = value - target
+			return
+		}
+		if i == len(coins) {
+			return
+		}
+
+		included[i] = true
+		search(i+1, value+coins[i].Value, remaining-coins[i].Value)
+		included[i] = false
+		search(i+1, value, remaining-coins[i].Value)
+	}
+	search(0, 0, remaining)
+
+	if best == nil {
+		return accumulate(coins, target)
+	}
+
+	var selected []SpendableCoin
+	for i, ok := range best {
+		if ok {
+			selected = append(selected, coins[i])
+		}
+	}
+	return selected, true
+}
+
+// excludingCoins chooses with CoinSelector among coins other than those
+// in spent, keyed by hex outpoint, such as ones spent by transactions not
+// yet mined.
+type excludingCoins struct {
+	CoinSelector
+	spent map[string]bool
+}
+
+func (s excludingCoins) SelectCoins(candidates []SpendableCoin, target, costOfChange int) ([]SpendableCoin, bool) {
+	var coins []SpendableCoin
+	for _, coin := range candidates {
+		if !s.spent[hex.EncodeToString(outpointKey(coin.Txid, coin.Vout))] {
+			coins = append(coins, coin)
+		}
+	}
+	return s.CoinSelector.SelectCoins(coins, target, costOfChange)
+}
+
+// SelectInputs chooses with selector coins of pubKeyHash worth at least
+// target, leaving out coins costing more to spend at feeRate than they
+// are worth, and returns inputs with sequence spending them and their
+// total value.
+func (u UTXOSet) SelectInputs(pubKeyHash []byte, target, feeRate int, selector CoinSelector, sequence uint32) ([]TXInput, int) {
+	var candidates []SpendableCoin
+	for _, coin := range u.FindSpendableCoins(pubKeyHash) {
+		if coin.Value*feeRateSize >= feeRate*inputSize {
+			candidates = append(candidates, coin)
+		}
+	}
+
+	coins, ok := selector.SelectCoins(candidates, target, changeCost(feeRate))
+	if !ok {
+		log.Panic("ERROR: Not enough funds")
+	}
+
+	var inputs []TXInput
+	value := 0
+	for _, coin := range coins {
+		inputs = append(inputs, TXInput{coin.Txid, coin.Vout, nil, nil, nil, sequence})
+		value += coin.Value
+	}
+	return inputs, value
+}
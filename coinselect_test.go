@@ -0,0 +1,104 @@
+package main
+
+import (
+	"sort"
+	"testing"
+)
+
+func testCoins(values ...int) []SpendableCoin {
+	var coins []SpendableCoin
+	for i, value := range values {
+		coins = append(coins, SpendableCoin{[]byte{byte(i)}, 0, value})
+	}
+	return coins
+}
+
+func coinValues(coins []SpendableCoin) []int {
+	var values []int
+	for _, coin := range coins {
+		values = append(values, coin.Value)
+	}
+	sort.Sort(sort.Reverse(sort.IntSlice(values)))
+	return values
+}
+
+func TestSelectCoins(t *testing.T) {
+	tests := []struct {
+		name         string
+		selector     CoinSelector
+		candidates   []int
+		target       int
+		costOfChange int
+		selected     []int
+		change       int
+	}{
+		{"largest first", LargestFirst{}, []int{1, 2, 5, 8, 13}, 10, 0, []int{13}, 3},
+		{"smallest first", SmallestFirst{}, []int{1, 2, 5, 8, 13}, 10, 0, []int{8, 5, 2, 1}, 6},
+		{"branch and bound exact", BranchAndBound{}, []int{1, 2, 5, 8, 13}, 10, 0, []int{8, 2}, 0},
+		{"branch and bound within change cost", BranchAndBound{}, []int{5, 8, 13}, 7, 1, []int{8}, 1},
+		{"branch and bound falls back to largest first", BranchAndBound{}, []int{5, 8, 13}, 7, 0, []int{13}, 6},
+		{"excluding spent coins", excludingCoins{LargestFirst{}, map[string]bool{"0400000000": true}}, []int{1, 2, 5, 8, 13}, 10, 0, []int{8, 5}, 3},
+	}
+	for _, test := range tests {
+		coins, ok := test.selector.SelectCoins(testCoins(test.candidates...), test.target, test.costOfChange)
+		values := coinValues(coins)
+		change := -test.target
+		for _, value := range values {
+			change += value
+		}
+		if !ok || len(values) != len(test.selected) || change != test.change {
+			t.Errorf("%s: selected %v with change %d, want %v with change %d", test.name, values, change, test.selected, test.change)
+			continue
+		}
+		for i := range values {
+			if values[i] != test.selected[i] {
+				t.Errorf("%s: selected %v, want %v", test.name, values, test.selected)
+				break
+			}
+		}
+	}
+}
+
+// TestRandomSelection checks that random selections pay the target
+// without a coin more than they need.
+func TestRandomSelection(t *testing.T) {
+	candidates := testCoins(1, 2, 5, 8, 13)
+	for i := 0; i < 20; i++ {
+		coins, ok := RandomSelection{}.SelectCoins(candidates, 10, 0)
+		value := 0
+		for _, coin := range coins {
+			value += coin.Value
+		}
+		if !ok || value < 10 || value-coins[len(coins)-1].Value >= 10 {
+			t.Fatalf("selected %v, want coins worth at least 10 only with the last", coinValues(coins))
+		}
+	}
+}
+
+func TestSelectCoinsInsufficient(t *testing.T) {
+	for name, selector := range coinSelectors {
+		if _, ok := selector.SelectCoins(testCoins(1, 2, 5), 9, 0); ok {
+			t.Errorf("%s: selected coins worth 8 for a target of 9", name)
+		}
+	}
+}
+
+// TestIsDust checks that outputs are priced at the relay's dust rate
+// unless the caller's rate is higher.
+func TestIsDust(t *testing.T) {
+	tests := []struct {
+		value, feeRate int
+		dust           bool
+	}{
+		{1, 0, true},
+		{2, 0, false},
+		{2, dustRelayFeeRate, false},
+		{2, 10, true},
+		{3, 10, false},
+	}
+	for _, test := range tests {
+		if dust := isDust(test.value, test.feeRate); dust != test.dust {
+			t.Errorf("isDust(%d, %d) = %v, want %v", test.value, test.feeRate, dust, test.dust)
+		}
+	}
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/hex"
+	"sort"
+
+	"github.com/boltdb/bolt"
+)
+
+const feeEstimatesBucket = "feeestimates"
+
+// maxConfirmTarget is the most blocks a fee can be estimated for. A
+// transaction still unconfirmed after that long counts as having failed.
+const maxConfirmTarget = 25
+
+// feeEstimateDecay scales down the history at every block so recent
+// blocks count the most.
+const feeEstimateDecay = 0.998
+
+// A fee rate bucket needs minBucketTxs of (decayed) history, of which
+// estimateSuccessRate must have confirmed within the target.
+const minBucketTxs = 3
+const estimateSuccessRate = 0.85
+
+// feeRateBuckets are the lowest fee rates of each bucket history is kept
+// for.
+var feeRateBuckets = []int{0, 1, 2, 3, 4, 6, 8, 11, 16, 22, 32, 45, 64, 90, 128}
+
+type trackedTx struct {
+	Height  int
+	FeeRate int
+	Size    int
+}
+
+// FeeEstimator records how many blocks the transactions accepted into the
+// mempool took to confirm, by fee rate bucket. It is stored with the chain
+// and updated as blocks are connected.
+type FeeEstimator struct {
+	// Confirmed[b][t] counts bucket b transactions that confirmed within
+	// t+1 blocks, and Total[b] all bucket b transactions that confirmed
+	// or expired.
+	Confirmed [][]float64
+	Total     []float64
+	// Mempool holds the transactions accepted but not yet confirmed.
+	Mempool map[string]trackedTx
+}
+
+func NewFeeEstimator() *FeeEstimator {
+	fe := &FeeEstimator{
+		Confirmed: make([][]float64, len(feeRateBuckets)),
+		Total:     make([]float64, len(feeRateBuckets)),
+		Mempool:   make(map[string]trackedTx),
+	}
+	for b := range fe.Confirmed {
+		fe.Confirmed[b] = make([]float64, maxConfirmTarget)
+	}
+	return fe
+}
+
+func loadFeeEstimator(t *bolt.Tx) *FeeEstimator {
+	b := t.Bucket([]byte(feeEstimatesBucket))
+	if b == nil || b.Get([]byte("l")) == nil {
+		return NewFeeEstimator()
+	}
+
+	fe := NewFeeEstimator()
+	err := gob.NewDecoder(bytes.NewReader(b.Get([]byte("l")))).Decode(fe)
+	if err != nil {
+		panic(err)
+	}
+	return fe
+}
+
+func (fe *FeeEstimator) save(t *bolt.Tx) error {
+	b, err := t.CreateBucketIfNotExists([]byte(feeEstimatesBucket))
+	if err != nil {
+		return err
+	}
+	return b.Put([]byte("l"), gobEncode(fe))
+}
+
+func feeRateBucket(feeRate int) int {
+	return sort.Search(len(feeRateBuckets), func(b int) bool { return feeRateBuckets[b] > feeRate }) - 1
+}
+
+// Track starts timing the confirmation of a transaction of size bytes
+// paying fee, accepted when the tip was at height.
+func (fe *FeeEstimator) Track(txid []byte, height, fee, size int) {
+	fe.Mempool[hex.EncodeToString(txid)] = trackedTx{height, fee * feeRateSize / size, size}
+}
+
+// processBlock records the tracked transactions confirmed by block and
+// expires those that have waited longer than maxConfirmTarget.
+func (fe *FeeEstimator) processBlock(block *Block) {
+	for b := range fe.Total {
+		fe.Total[b] *= feeEstimateDecay
+		for t := range fe.Confirmed[b] {
+			fe.Confirmed[b][t] *= feeEstimateDecay
+		}
+	}
+
+	for _, tx := range block.Transactions {
+		txID := hex.EncodeToString(tx.ID)
+		entry, ok := fe.Mempool[txID]
+		if !ok {
+			continue
+		}
+		delete(fe.Mempool, txID)
+
+		b := feeRateBucket(entry.FeeRate)
+		fe.Total[b]++
+		waited := block.Height - entry.Height
+		if waited < 1 {
+			waited = 1
+		}
+		for t := waited - 1; t < maxConfirmTarget; t++ {
+			fe.Confirmed[b][t]++
+		}
+	}
+
+	for txID, entry := range fe.Mempool {
+		if block.Height-entry.Height >= maxConfirmTarget {
+			delete(fe.Mempool, txID)
+			fe.Total[feeRateBucket(entry.FeeRate)]++
+		}
+	}
+}
+
+// EstimateFee returns the fee rate per feeRateSize bytes needed to confirm
+// within blocks blocks. It is the lowest rate whose history shows enough
+// transactions confirming in time or, with too little history, the rate
+// needed to outbid the mempool for the space blocks blocks have.
+func (fe *FeeEstimator) EstimateFee(blocks int) int {
+	if blocks < 1 {
+		blocks = 1
+	}
+	if blocks > maxConfirmTarget {
+		blocks = maxConfirmTarget
+	}
+
+	if feeRate, ok := fe.historicalEstimate(blocks); ok {
+		return feeRate
+	}
+	return fe.mempoolEstimate(blocks)
+}
+
+// historicalEstimate walks the buckets from the highest fee rate down,
+// merging buckets until they have enough history, and returns the lowest
+// rate that still confirmed within blocks often enough.
+func (fe *FeeEstimator) historicalEstimate(blocks int) (int, bool) {
+	passing := -1
+	var confirmed, total float64
+
+	for b := len(feeRateBuckets) - 1; b >= 0; b-- {
+		confirmed += fe.Confirmed[b][blocks-1]
+		total += fe.Total[b]
+		if total < minBucketTxs {
+			continue
+		}
+		if confirmed/total < estimateSuccessRate {
+			break
+		}
+		passing = b
+		confirmed, total = 0, 0
+	}
+
+	if passing < 0 {
+		return 0, false
+	}
+	return feeRateBuckets[passing], true
+}
+
+// mempoolEstimate assumes miners fill blocks with the best paying
+// transactions and returns the rate that beats the first transaction left
+// out of the next blocks blocks.
+func (fe *FeeEstimator) mempoolEstimate(blocks int) int {
+	var entries []trackedTx
+	for _, entry := range fe.Mempool {
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].FeeRate > entries[j].FeeRate })
+
+	size := 0
+	for _, entry := range entries {
+		size += entry.Size
+		if size > blocks*blockMaxSize {
+			return entry.FeeRate + 1
+		}
+	}
+	return 0
+}
+
+// TrackFee starts timing the confirmation of tx, paying fee, which has
+// just been accepted into the mempool.
+func (bc *Blockchain) TrackFee(tx *Transaction, fee int) {
+	err := bc.db.Update(func(t *bolt.Tx) error {
+		tip := DeserializeBlock(t.Bucket([]byte(blocksBucket)).Get(bc.tip))
+		fe := loadFeeEstimator(t)
+		fe.Track(tx.ID, tip.Height, fee, tx.Size())
+		return fe.save(t)
+	})
+	if err != nil {
+		panic(err)
+	}
+}
+
+// UntrackFees stops timing the transactions txIDs, which have left the
+// mempool without being mined.
+func (bc *Blockchain) UntrackFees(txIDs []string) {
+	err := bc.db.Update(func(t *bolt.Tx) error {
+		fe := loadFeeEstimator(t)
+		for _, txID := range txIDs {
+			delete(fe.Mempool, txID)
+		}
+		return fe.save(t)
+	})
+	if err != nil {
+		panic(err)
+	}
+}
+
+// EstimateFee returns the fee rate per feeRateSize bytes needed to confirm
+// within blocks blocks.
+func (bc *Blockchain) EstimateFee(blocks int) int {
+	var feeRate int
+
+	err := bc.db.View(func(t *bolt.Tx) error {
+		feeRate = loadFeeEstimator(t).EstimateFee(blocks)
+		return nil
+	})
+	if err != nil {
+		panic(err)
+	}
+	return feeRate
+}
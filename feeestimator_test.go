@@ -0,0 +1,69 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+// TestEstimateFeeMempool checks that with no history the estimate is the
+// rate that outbids the mempool for the space of the target blocks.
+func TestEstimateFeeMempool(t *testing.T) {
+	fe := NewFeeEstimator()
+	if feeRate := fe.EstimateFee(1); feeRate != 0 {
+		t.Errorf("empty estimator: EstimateFee(1) = %d, want 0", feeRate)
+	}
+
+	size := blockMaxSize / 2
+	for i, feeRate := range []int{50, 30, 10} {
+		fe.Track([]byte{byte(i)}, 1, feeRate*size/feeRateSize, size)
+	}
+
+	tests := []struct {
+		blocks  int
+		feeRate int
+	}{
+		{1, 11},
+		{2, 0},
+		{0, 11},
+	}
+	for _, test := range tests {
+		if feeRate := fe.EstimateFee(test.blocks); feeRate != test.feeRate {
+			t.Errorf("EstimateFee(%d) = %d, want %d", test.blocks, feeRate, test.feeRate)
+		}
+	}
+}
+
+// TestEstimateFeeHistory confirms transactions at a high rate in the next
+// block and at a low rate five blocks later, and checks that each rate is
+// the estimate for the targets it met, whatever the mempool holds.
+func TestEstimateFeeHistory(t *testing.T) {
+	fe := NewFeeEstimator()
+	var fast, slow []*Transaction
+	for i := 0; i < minBucketTxs+2; i++ {
+		fast = append(fast, &Transaction{ID: []byte(fmt.Sprintf("fast%d", i))})
+		slow = append(slow, &Transaction{ID: []byte(fmt.Sprintf("slow%d", i))})
+		fe.Track(fast[i].ID, 1, 16, feeRateSize)
+		fe.Track(slow[i].ID, 1, 2, feeRateSize)
+	}
+	fe.processBlock(&Block{Height: 2, Transactions: fast})
+	for height := 3; height < 6; height++ {
+		fe.processBlock(&Block{Height: height})
+	}
+	fe.processBlock(&Block{Height: 6, Transactions: slow})
+	fe.Track([]byte("pending"), 6, 100*blockMaxSize, 2*blockMaxSize)
+
+	tests := []struct {
+		blocks  int
+		feeRate int
+	}{
+		{1, 16},
+		{4, 16},
+		{5, 2},
+		{maxConfirmTarget + 1, 2},
+	}
+	for _, test := range tests {
+		if feeRate := fe.EstimateFee(test.blocks); feeRate != test.feeRate {
+			t.Errorf("EstimateFee(%d) = %d, want %d", test.blocks, feeRate, test.feeRate)
+		}
+	}
+}
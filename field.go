@@ -0,0 +1,198 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/binary"
+	"math/big"
+	"math/bits"
+)
+
+// fieldElement is an integer modulo the modulus of a montField, in
+// Montgomery form, as four 64-bit limbs with the least significant first.
+type fieldElement [4]uint64
+
+// montField does arithmetic modulo an odd modulus m below 2²⁵⁶. Its
+// operations take the same time whatever the values they are given, so
+// they can be used on private keys and nonces.
+type montField struct {
+	m fieldElement
+	// mInv is -m⁻¹ mod 2⁶⁴ and rr is R² mod m, where R is 2²⁵⁶.
+	mInv uint64
+	rr   fieldElement
+	// invExp is m - 2, by which elements are raised to invert them when
+	// m is prime.
+	invExp []byte
+}
+
+func newMontField(m *big.Int) *montField {
+	f := &montField{m: limbs(m)}
+
+	// Each step of Newton's iteration doubles the bits of m⁻¹ that are
+	// right, starting from the one bit of 1 that is.
+	inv := uint64(1)
+	for i := 0; i < 6; i++ {
+		inv *= 2 - f.m[0]*inv
+	}
+	f.mInv = -inv
+
+	rr := new(big.Int).Lsh(big.NewInt(1), 512)
+	f.rr = limbs(rr.Mod(rr, m))
+	f.invExp = new(big.Int).Sub(m, big.NewInt(2)).FillBytes(make([]byte, 32))
+	return f
+}
+
+// limbs splits x, which must be below 2²⁵⁶, into limbs.
+func limbs(x *big.Int) fieldElement {
+	return limbsFromBytes(x.FillBytes(make([]byte, 32)))
+}
+
+// limbsFromBytes splits the 32 big-endian bytes b into limbs.
+func limbsFromBytes(b []byte) fieldElement {
+	var z fieldElement
+	for i := range z {
+		z[i] = binary.BigEndian.Uint64(b[24-8*i:])
+	}
+	return z
+}
+
+// fromBig returns x, which must be below 2²⁵⁶, reduced and in Montgomery
+// form.
+func (f *montField) fromBig(x *big.Int) fieldElement {
+	return f.mul(limbs(x), f.rr)
+}
+
+// bytes returns x as 32 big-endian bytes.
+func (f *montField) bytes(x fieldElement) []byte {
+	x = f.mul(x, fieldElement{1})
+	b := make([]byte, 32)
+	for i := range x {
+		binary.BigEndian.PutUint64(b[24-8*i:], x[i])
+	}
+	return b
+}
+
+func (f *montField) toBig(x fieldElement) *big.Int {
+	return new(big.Int).SetBytes(f.bytes(x))
+}
+
+// one returns 1 in Montgomery form.
+func (f *montField) one() fieldElement {
+	return f.mul(fieldElement{1}, f.rr)
+}
+
+// mul returns x·y·R⁻¹ mod m, by the coarsely integrated operand scanning
+// method. One of x and y may be any value below 2²⁵⁶ if the other is
+// reduced.
+func (f *montField) mul(x, y fieldElement) fieldElement {
+	var t [6]uint64
+	for i := 0; i < 4; i++ {
+		var c, carry uint64
+		for j := 0; j < 4; j++ {
+			hi, lo := bits.Mul64(x[j], y[i])
+			lo, carry = bits.Add64(lo, t[j], 0)
+			hi += carry
+			lo, carry = bits.Add64(lo, c, 0)
+			hi += carry
+			t[j], c = lo, hi
+		}
+		t[4], t[5] = bits.Add64(t[4], c, 0)
+
+		q := t[0] * f.mInv
+		hi, lo := bits.Mul64(q, f.m[0])
+		_, carry = bits.Add64(lo, t[0], 0)
+		c = hi + carry
+		for j := 1; j < 4; j++ {
+			hi, lo = bits.Mul64(q, f.m[j])
+			lo, carry = bits.Add64(lo, t[j], 0)
+			hi += carry
+			lo, carry = bits.Add64(lo, c, 0)
+			hi += carry
+			t[j-1], c = lo, hi
+		}
+		t[3], carry = bits.Add64(t[4], c, 0)
+		t[4] = t[5] + carry
+	}
+	return f.reduce(fieldElement{t[0], t[1], t[2], t[3]}, t[4])
+}
+
+// reduce returns t, which with the carry above its limbs is below 2m,
+// minus m if it is at least m.
+func (f *montField) reduce(t fieldElement, carry uint64) fieldElement {
+	var d fieldElement
+	var borrow uint64
+	for i := range d {
+		d[i], borrow = bits.Sub64(t[i], f.m[i], borrow)
+	}
+	_, borrow = bits.Sub64(carry, 0, borrow)
+	return selectElement(borrow, t, d)
+}
+
+// selectElement returns x if c is 1 and y if it is 0.
+func selectElement(c uint64, x, y fieldElement) fieldElement {
+	mask := -c
+	var z fieldElement
+	for i := range z {
+		z[i] = x[i]&mask | y[i]&^mask
+	}
+	return z
+}
+
+func (f *montField) add(x, y fieldElement) fieldElement {
+	var z fieldElement
+	var carry uint64
+	for i := range z {
+		z[i], carry = bits.Add64(x[i], y[i], carry)
+	}
+	return f.reduce(z, carry)
+}
+
+func (f *montField) sub(x, y fieldElement) fieldElement {
+	var z fieldElement
+	var borrow, carry uint64
+	for i := range z {
+		z[i], borrow = bits.Sub64(x[i], y[i], borrow)
+	}
+	mask := -borrow
+	for i := range z {
+		z[i], carry = bits.Add64(z[i], f.m[i]&mask, carry)
+	}
+	return z
+}
+
+// isZero returns 1 if x is 0 and 0 otherwise.
+func isZero(x fieldElement) uint64 {
+	acc := x[0] | x[1] | x[2] | x[3]
+	return 1 ^ (acc|-acc)>>63
+}
+
+// exp returns x raised to the big-endian exponent e, taking four bits of
+// e at a time and looking up the power of x for them without branching
+// on their value.
+func (f *montField) exp(x fieldElement, e []byte) fieldElement {
+	var table [16]fieldElement
+	table[0] = f.one()
+	table[1] = x
+	for i := 2; i < len(table); i++ {
+		table[i] = f.mul(table[i-1], x)
+	}
+
+	z := table[0]
+	for _, b := range e {
+		for _, w := range [2]byte{b >> 4, b & 0x0f} {
+			for i := 0; i < 4; i++ {
+				z = f.mul(z, z)
+			}
+			var power fieldElement
+			for i := range table {
+				power = selectElement(uint64(subtle.ConstantTimeByteEq(byte(i), w)), table[i], power)
+			}
+			z = f.mul(z, power)
+		}
+	}
+	return z
+}
+
+// inverse returns x⁻¹, or 0 if x is 0, for a prime modulus.
+func (f *montField) inverse(x fieldElement) fieldElement {
+	return f.exp(x, f.invExp)
+}
@@ -0,0 +1,643 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+
+	"golang.org/x/crypto/ripemd160"
+)
+
+const maxScriptSize = 10000
+const maxScriptElementSize = 520
+const maxOpsPerScript = 201
+const maxStackSize = 1000
+const maxPubKeysPerMultisig = 20
+
+// maxScriptNumLen is the longest number arithmetic ops accept.
+const maxScriptNumLen = 4
+const maxLockTimeNumLen = 5
+
+// SigChecker verifies signatures and timelocks on behalf of the
+// interpreter. subscript is the locking script being executed, which the
+// signature hash commits to.
+type SigChecker interface {
+	CheckSig(signature, pubKey, subscript []byte) bool
+	CheckLockTime(lockTime int64) bool
+	CheckSequence(sequence int64) bool
+}
+
+type scriptNum int64
+
+// Bytes encodes n as a minimal little-endian number with a sign bit.
+func (n scriptNum) Bytes() []byte {
+	if n == 0 {
+		return nil
+	}
+
+	negative := n < 0
+	abs := n
+	if negative {
+		abs = -n
+	}
+
+	var result []byte
+	for abs > 0 {
+		result = append(result, byte(abs&0xff))
+		abs >>= 8
+	}
+
+	if result[len(result)-1]&0x80 != 0 {
+		if negative {
+			result = append(result, 0x80)
+		} else {
+			result = append(result, 0x00)
+		}
+	} else if negative {
+		result[len(result)-1] |= 0x80
+	}
+
+	return result
+}
+
+func makeScriptNum(data []byte, maxLen int) (scriptNum, error) {
+	if len(data) > maxLen {
+		return 0, errors.New("script: number too long")
+	}
+	if len(data) > 0 && data[len(data)-1]&0x7f == 0 {
+		if len(data) == 1 || data[len(data)-2]&0x80 == 0 {
+			return 0, errors.New("script: number not minimally encoded")
+		}
+	}
+
+	var n int64
+	for i, b := range data {
+		n |= int64(b) << uint(8*i)
+	}
+	if len(data) > 0 && data[len(data)-1]&0x80 != 0 {
+		n &^= int64(0x80) << uint(8*(len(data)-1))
+		n = -n
+	}
+	return scriptNum(n), nil
+}
+
+func castToBool(data []byte) bool {
+	for i, b := range data {
+		if b != 0 {
+			// negative zero is false
+			return !(i == len(data)-1 && b == 0x80)
+		}
+	}
+	return false
+}
+
+func fromBool(v bool) []byte {
+	if v {
+		return []byte{1}
+	}
+	return nil
+}
+
+type stack [][]byte
+
+func (s *stack) push(data []byte) {
+	*s = append(*s, data)
+}
+
+func (s *stack) pop() ([]byte, error) {
+	if len(*s) == 0 {
+		return nil, errors.New("script: stack underflow")
+	}
+	data := (*s)[len(*s)-1]
+	*s = (*s)[:len(*s)-1]
+	return data, nil
+}
+
+// peek returns the element depth places below the top of the stack.
+func (s stack) peek(depth int) ([]byte, error) {
+	if depth < 0 || depth >= len(s) {
+		return nil, errors.New("script: stack underflow")
+	}
+	return s[len(s)-1-depth], nil
+}
+
+func (s *stack) popNum() (scriptNum, error) {
+	data, err := s.pop()
+	if err != nil {
+		return 0, err
+	}
+	return makeScriptNum(data, maxScriptNumLen)
+}
+
+func (s *stack) popBool() (bool, error) {
+	data, err := s.pop()
+	if err != nil {
+		return false, err
+	}
+	return castToBool(data), nil
+}
+
+type engine struct {
+	stack     stack
+	alt       stack
+	checker   SigChecker
+	script    []byte
+	numOps    int
+	condStack []bool
+}
+
+func (e *engine) executing() bool {
+	for _, cond := range e.condStack {
+		if !cond {
+			return false
+		}
+	}
+	return true
+}
+
+// run executes script against the engine's current stack.
+func (e *engine) run(script []byte) error {
+	if len(script) > maxScriptSize {
+		return errors.New("script: script too large")
+	}
+	ops, err := parseScript(script)
+	if err != nil {
+		return err
+	}
+
+	e.script = script
+	e.numOps = 0
+	e.condStack = nil
+
+	for _, op := range ops {
+		err := e.step(op)
+		if err != nil {
+			return err
+		}
+		if len(e.stack)+len(e.alt) > maxStackSize {
+			return errors.New("script: stack size limit exceeded")
+		}
+	}
+
+	if len(e.condStack) != 0 {
+		return errors.New("script: unbalanced conditional")
+	}
+	return nil
+}
+
+func (e *engine) step(op scriptOp) error {
+	if len(op.data) > maxScriptElementSize {
+		return errors.New("script: push exceeds element size limit")
+	}
+	if op.opcode > OP_16 {
+		e.numOps++
+		if e.numOps > maxOpsPerScript {
+			return errors.New("script: operation limit exceeded")
+		}
+	}
+
+	switch op.opcode {
+	case OP_IF, OP_NOTIF:
+		cond := false
+		if e.executing() {
+			v, err := e.stack.popBool()
+			if err != nil {
+				return err
+			}
+			cond = v == (op.opcode == OP_IF)
+		}
+		e.condStack = append(e.condStack, cond)
+		return nil
+	case OP_ELSE:
+		if len(e.condStack) == 0 {
+			return errors.New("script: OP_ELSE without OP_IF")
+		}
+		e.condStack[len(e.condStack)-1] = !e.condStack[len(e.condStack)-1]
+		return nil
+	case OP_ENDIF:
+		if len(e.condStack) == 0 {
+			return errors.New("script: OP_ENDIF without OP_IF")
+		}
+		e.condStack = e.condStack[:len(e.condStack)-1]
+		return nil
+	}
+
+	if !e.executing() {
+		return nil
+	}
+
+	if op.opcode <= OP_PUSHDATA4 {
+		e.stack.push(op.data)
+		return nil
+	}
+	if op.opcode == OP_1NEGATE || (op.opcode >= OP_1 && op.opcode <= OP_16) {
+		e.stack.push(scriptNum(int(op.opcode) - (OP_1 - 1)).Bytes())
+		return nil
+	}
+
+	switch op.opcode {
+	case OP_NOP:
+	case OP_VERIFY:
+		v, err := e.stack.popBool()
+		if err != nil {
+			return err
+		}
+		if !v {
+			return errors.New("script: OP_VERIFY failed")
+		}
+	case OP_RETURN:
+		return errors.New("script: OP_RETURN executed")
+
+	case OP_TOALTSTACK:
+		data, err := e.stack.pop()
+		if err != nil {
+			return err
+		}
+		e.alt.push(data)
+	case OP_FROMALTSTACK:
+		data, err := e.alt.pop()
+		if err != nil {
+			return err
+		}
+		e.stack.push(data)
+	case OP_2DROP:
+		if len(e.stack) < 2 {
+			return errors.New("script: stack underflow")
+		}
+		e.stack = e.stack[:len(e.stack)-2]
+	case OP_2DUP:
+		a, err := e.stack.peek(1)
+		if err != nil {
+			return err
+		}
+		b, _ := e.stack.peek(0)
+		e.stack.push(a)
+		e.stack.push(b)
+	case OP_IFDUP:
+		data, err := e.stack.peek(0)
+		if err != nil {
+			return err
+		}
+		if castToBool(data) {
+			e.stack.push(data)
+		}
+	case OP_DEPTH:
+		e.stack.push(scriptNum(len(e.stack)).Bytes())
+	case OP_DROP:
+		_, err := e.stack.pop()
+		return err
+	case OP_DUP:
+		data, err := e.stack.peek(0)
+		if err != nil {
+			return err
+		}
+		e.stack.push(data)
+	case OP_NIP:
+		if len(e.stack) < 2 {
+			return errors.New("script: stack underflow")
+		}
+		e.stack = append(e.stack[:len(e.stack)-2], e.stack[len(e.stack)-1])
+	case OP_OVER:
+		data, err := e.stack.peek(1)
+		if err != nil {
+			return err
+		}
+		e.stack.push(data)
+	case OP_ROT:
+		if len(e.stack) < 3 {
+			return errors.New("script: stack underflow")
+		}
+		n := len(e.stack)
+		e.stack[n-3], e.stack[n-2], e.stack[n-1] = e.stack[n-2], e.stack[n-1], e.stack[n-3]
+	case OP_SWAP:
+		if len(e.stack) < 2 {
+			return errors.New("script: stack underflow")
+		}
+		n := len(e.stack)
+		e.stack[n-2], e.stack[n-1] = e.stack[n-1], e.stack[n-2]
+	case OP_SIZE:
+		data, err := e.stack.peek(0)
+		if err != nil {
+			return err
+		}
+		e.stack.push(scriptNum(len(data)).Bytes())
+
+	case OP_EQUAL, OP_EQUALVERIFY:
+		a, err := e.stack.pop()
+		if err != nil {
+			return err
+		}
+		b, err := e.stack.pop()
+		if err != nil {
+			return err
+		}
+		equal := bytes.Equal(a, b)
+		if op.opcode == OP_EQUALVERIFY {
+			if !equal {
+				return errors.New("script: OP_EQUALVERIFY failed")
+			}
+			return nil
+		}
+		e.stack.push(fromBool(equal))
+
+	case OP_1ADD, OP_1SUB, OP_NOT, OP_0NOTEQUAL:
+		n, err := e.stack.popNum()
+		if err != nil {
+			return err
+		}
+		switch op.opcode {
+		case OP_1ADD:
+			n++
+		case OP_1SUB:
+			n--
+		case OP_NOT:
+			n = scriptNum(boolToInt(n == 0))
+		case OP_0NOTEQUAL:
+			n = scriptNum(boolToInt(n != 0))
+		}
+		e.stack.push(n.Bytes())
+
+	case OP_ADD, OP_SUB, OP_BOOLAND, OP_BOOLOR, OP_NUMEQUAL, OP_NUMEQUALVERIFY,
+		OP_LESSTHAN, OP_GREATERTHAN, OP_MIN, OP_MAX:
+		b, err := e.stack.popNum()
+		if err != nil {
+			return err
+		}
+		a, err := e.stack.popNum()
+		if err != nil {
+			return err
+		}
+
+		var n scriptNum
+		switch op.opcode {
+		case OP_ADD:
+			n = a + b
+		case OP_SUB:
+			n = a - b
+		case OP_BOOLAND:
+			n = scriptNum(boolToInt(a != 0 && b != 0))
+		case OP_BOOLOR:
+			n = scriptNum(boolToInt(a != 0 || b != 0))
+		case OP_NUMEQUAL, OP_NUMEQUALVERIFY:
+			n = scriptNum(boolToInt(a == b))
+		case OP_LESSTHAN:
+			n = scriptNum(boolToInt(a < b))
+		case OP_GREATERTHAN:
+			n = scriptNum(boolToInt(a > b))
+		case OP_MIN:
+			n = a
+			if b < a {
+				n = b
+			}
+		case OP_MAX:
+			n = a
+			if b > a {
+				n = b
+			}
+		}
+
+		if op.opcode == OP_NUMEQUALVERIFY {
+			if n == 0 {
+				return errors.New("script: OP_NUMEQUALVERIFY failed")
+			}
+			return nil
+		}
+		e.stack.push(n.Bytes())
+
+	case OP_WITHIN:
+		max, err := e.stack.popNum()
+		if err != nil {
+			return err
+		}
+		min, err := e.stack.popNum()
+		if err != nil {
+			return err
+		}
+		x, err := e.stack.popNum()
+		if err != nil {
+			return err
+		}
+		e.stack.push(fromBool(min <= x && x < max))
+
+	case OP_RIPEMD160, OP_SHA256, OP_HASH160, OP_HASH256:
+		data, err := e.stack.pop()
+		if err != nil {
+			return err
+		}
+		switch op.opcode {
+		case OP_RIPEMD160:
+			data = ripemd160Sum(data)
+		case OP_SHA256:
+			hash := sha256.Sum256(data)
+			data = hash[:]
+		case OP_HASH160:
+			data = HashPubKey(data)
+		case OP_HASH256:
+			first := sha256.Sum256(data)
+			second := sha256.Sum256(first[:])
+			data = second[:]
+		}
+		e.stack.push(data)
+
+	case OP_CHECKSIG, OP_CHECKSIGVERIFY:
+		pubKey, err := e.stack.pop()
+		if err != nil {
+			return err
+		}
+		signature, err := e.stack.pop()
+		if err != nil {
+			return err
+		}
+
+		valid := len(signature) > 0 && e.checker.CheckSig(signature, pubKey, e.script)
+		if op.opcode == OP_CHECKSIGVERIFY {
+			if !valid {
+				return errors.New("script: OP_CHECKSIGVERIFY failed")
+			}
+			return nil
+		}
+		e.stack.push(fromBool(valid))
+
+	case OP_CHECKLOCKTIMEVERIFY:
+		if len(e.stack) == 0 {
+			return errors.New("script: stack underflow")
+		}
+		// The locktime is left on the stack.
+		lockTime, err := makeScriptNum(e.stack[len(e.stack)-1], maxLockTimeNumLen)
+		if err != nil {
+			return err
+		}
+		if lockTime < 0 {
+			return errors.New("script: negative locktime")
+		}
+		if !e.checker.CheckLockTime(int64(lockTime)) {
+			return errors.New("script: locktime requirement not satisfied")
+		}
+
+	case OP_CHECKSEQUENCEVERIFY:
+		if len(e.stack) == 0 {
+			return errors.New("script: stack underflow")
+		}
+		// The sequence is left on the stack.
+		sequence, err := makeScriptNum(e.stack[len(e.stack)-1], maxLockTimeNumLen)
+		if err != nil {
+			return err
+		}
+		if sequence < 0 {
+			return errors.New("script: negative sequence")
+		}
+		if sequence&SequenceLockTimeDisableFlag != 0 {
+			return nil
+		}
+		if !e.checker.CheckSequence(int64(sequence)) {
+			return errors.New("script: relative locktime requirement not satisfied")
+		}
+
+	case OP_CHECKMULTISIG, OP_CHECKMULTISIGVERIFY:
+		valid, err := e.checkMultisig()
+		if err != nil {
+			return err
+		}
+		if op.opcode == OP_CHECKMULTISIGVERIFY {
+			if !valid {
+				return errors.New("script: OP_CHECKMULTISIGVERIFY failed")
+			}
+			return nil
+		}
+		e.stack.push(fromBool(valid))
+
+	default:
+		return fmt.Errorf("script: unknown opcode 0x%02x", op.opcode)
+	}
+
+	return nil
+}
+
+// checkMultisig pops <sig 1> ... <sig m> m <pubkey 1> ... <pubkey n> n and
+// reports whether every signature matches one of the keys, in key order.
+// Unlike Bitcoin there is no extra dummy element.
+func (e *engine) checkMultisig() (bool, error) {
+	n, err := e.stack.popNum()
+	if err != nil {
+		return false, err
+	}
+	if n < 0 || n > maxPubKeysPerMultisig {
+		return false, errors.New("script: invalid public key count")
+	}
+	e.numOps += int(n)
+	if e.numOps > maxOpsPerScript {
+		return false, errors.New("script: operation limit exceeded")
+	}
+
+	pubKeys := make([][]byte, n)
+	for i := int(n) - 1; i >= 0; i-- {
+		pubKeys[i], err = e.stack.pop()
+		if err != nil {
+			return false, err
+		}
+	}
+
+	m, err := e.stack.popNum()
+	if err != nil {
+		return false, err
+	}
+	if m < 0 || m > n {
+		return false, errors.New("script: invalid signature count")
+	}
+
+	signatures := make([][]byte, m)
+	for i := int(m) - 1; i >= 0; i-- {
+		signatures[i], err = e.stack.pop()
+		if err != nil {
+			return false, err
+		}
+	}
+
+	key := 0
+	for _, signature := range signatures {
+		for {
+			if len(pubKeys)-key < 1 {
+				return false, nil
+			}
+			matched := len(signature) > 0 && e.checker.CheckSig(signature, pubKeys[key], e.script)
+			key++
+			if matched {
+				break
+			}
+		}
+	}
+	return true, nil
+}
+
+func ripemd160Sum(data []byte) []byte {
+	hasher := ripemd160.New()
+	_, err := hasher.Write(data)
+	if err != nil {
+		panic(err)
+	}
+	return hasher.Sum(nil)
+}
+
+func boolToInt(v bool) int {
+	if v {
+		return 1
+	}
+	return 0
+}
+
+// VerifyScript runs unlocking, which must only push data, followed by
+// locking on the resulting stack, and succeeds if the final stack top is
+// true. If locking is pay-to-script-hash, the last element pushed by
+// unlocking is then run as the redeem script on the rest of the stack.
+func VerifyScript(unlocking, locking []byte, checker SigChecker) error {
+	ops, err := parseScript(unlocking)
+	if err != nil {
+		return err
+	}
+	if !isPushOnly(ops) {
+		return errors.New("script: unlocking script is not push only")
+	}
+
+	e := engine{checker: checker}
+	err = e.run(unlocking)
+	if err != nil {
+		return err
+	}
+	p2shStack := append(stack{}, e.stack...)
+
+	err = e.run(locking)
+	if err != nil {
+		return err
+	}
+	err = e.checkResult()
+	if err != nil {
+		return err
+	}
+
+	if !isPayToScriptHash(locking) {
+		return nil
+	}
+
+	redeemScript, err := p2shStack.pop()
+	if err != nil {
+		return err
+	}
+	e.stack = p2shStack
+	e.alt = nil
+	err = e.run(redeemScript)
+	if err != nil {
+		return err
+	}
+	return e.checkResult()
+}
+
+func (e *engine) checkResult() error {
+	if len(e.stack) == 0 {
+		return errors.New("script: empty stack")
+	}
+	if !castToBool(e.stack[len(e.stack)-1]) {
+		return errors.New("script: evaluated to false")
+	}
+	return nil
+}
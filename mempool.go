@@ -0,0 +1,363 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+
+	"github.com/boltdb/bolt"
+)
+
+const mempoolBucket = "mempool"
+
+// A mempool transaction may have at most maxMempoolAncestors unconfirmed
+// ancestors and maxMempoolDescendants descendants, counting itself.
+const maxMempoolAncestors = 25
+const maxMempoolDescendants = 25
+
+// Mempool holds the transactions waiting to be mined, keyed by hex txid.
+type Mempool map[string]Transaction
+
+// LoadMempool returns the mempool stored with bc.
+func LoadMempool(bc *Blockchain) Mempool {
+	mp := make(Mempool)
+
+	err := bc.db.View(func(t *bolt.Tx) error {
+		b := t.Bucket([]byte(mempoolBucket))
+		if b == nil {
+			return nil
+		}
+		return b.ForEach(func(k, v []byte) error {
+			mp[hex.EncodeToString(k)] = DeserializeTransaction(v)
+			return nil
+		})
+	})
+	if err != nil {
+		panic(err)
+	}
+	return mp
+}
+
+// Save replaces the mempool stored with bc by mp.
+func (mp Mempool) Save(bc *Blockchain) {
+	err := bc.db.Update(func(t *bolt.Tx) error {
+		err := t.DeleteBucket([]byte(mempoolBucket))
+		if err != nil && err != bolt.ErrBucketNotFound {
+			return err
+		}
+		b, err := t.CreateBucket([]byte(mempoolBucket))
+		if err != nil {
+			return err
+		}
+		for _, tx := range mp {
+			err := b.Put(tx.ID, tx.Serialize())
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		panic(err)
+	}
+}
+
+// PrevOutputs returns the outputs tx spends, keyed by hex outpoint, from
+// the unspent outputs of bc or the transactions in mp.
+func (mp Mempool) PrevOutputs(bc *Blockchain, tx *Transaction) (map[string]TXOutput, error) {
+	prevOuts := make(map[string]TXOutput)
+	for _, vin := range tx.Vin {
+		outpoint := outpointKey(vin.Txid, vin.Vout)
+		if parent, ok := mp[hex.EncodeToString(vin.Txid)]; ok && vin.Vout >= 0 && vin.Vout < len(parent.Vout) {
+			prevOuts[hex.EncodeToString(outpoint)] = parent.Vout[vin.Vout]
+			continue
+		}
+		coin, ok := bc.utxo.FetchCoin(outpoint)
+		if !ok {
+			return nil, fmt.Errorf("Output %x:%d is spent or does not exist", vin.Txid, vin.Vout)
+		}
+		prevOuts[hex.EncodeToString(outpoint)] = coin.Output
+	}
+	return prevOuts, nil
+}
+
+// Fee returns the fee paid by tx, whose inputs may spend outputs of
+// transactions in mp.
+func (mp Mempool) Fee(bc *Blockchain, tx *Transaction) int {
+	prevOuts, err := mp.PrevOutputs(bc, tx)
+	if err != nil {
+		panic(err)
+	}
+
+	fee := 0
+	for _, prevOut := range prevOuts {
+		fee += prevOut.Value
+	}
+	for _, out := range tx.Vout {
+		fee -= out.Value
+	}
+	return fee
+}
+
+// Conflicts returns the ids of the transactions in mp spending an output
+// that tx spends.
+func (mp Mempool) Conflicts(tx *Transaction) []string {
+	spends := make(map[string]bool)
+	for _, vin := range tx.Vin {
+		spends[hex.EncodeToString(outpointKey(vin.Txid, vin.Vout))] = true
+	}
+
+	var conflicts []string
+	for txID, other := range mp {
+		for _, vin := range other.Vin {
+			if spends[hex.EncodeToString(outpointKey(vin.Txid, vin.Vout))] {
+				conflicts = append(conflicts, txID)
+				break
+			}
+		}
+	}
+	return conflicts
+}
+
+// Descendants returns txIDs and the ids of every transaction in mp that
+// spends, directly or through other transactions in mp, their outputs.
+func (mp Mempool) Descendants(txIDs []string) []string {
+	found := make(map[string]bool)
+	for _, txID := range txIDs {
+		found[txID] = true
+	}
+
+	for queue := txIDs; len(queue) > 0; {
+		parent := queue[0]
+		queue = queue[1:]
+		for txID, tx := range mp {
+			if found[txID] {
+				continue
+			}
+			for _, vin := range tx.Vin {
+				if hex.EncodeToString(vin.Txid) == parent {
+					found[txID] = true
+					queue = append(queue, txID)
+					break
+				}
+			}
+		}
+	}
+
+	var descendants []string
+	for txID := range found {
+		descendants = append(descendants, txID)
+	}
+	return descendants
+}
+
+// Ancestors returns the ids of the transactions in mp whose outputs tx
+// spends, directly or through other transactions in mp.
+func (mp Mempool) Ancestors(tx *Transaction) []string {
+	found := make(map[string]bool)
+	var ancestors []string
+
+	for queue := []*Transaction{tx}; len(queue) > 0; {
+		child := queue[0]
+		queue = queue[1:]
+		for _, vin := range child.Vin {
+			parentID := hex.EncodeToString(vin.Txid)
+			parent, ok := mp[parentID]
+			if !ok || found[parentID] {
+				continue
+			}
+			found[parentID] = true
+			ancestors = append(ancestors, parentID)
+			queue = append(queue, &parent)
+		}
+	}
+	return ancestors
+}
+
+// sorted returns the transactions txIDs of mp with every transaction
+// after those of its parents that are among them.
+func (mp Mempool) sorted(txIDs []string) []*Transaction {
+	wanted := make(map[string]bool)
+	for _, txID := range txIDs {
+		wanted[txID] = true
+	}
+
+	var txs []*Transaction
+	var visit func(txID string)
+	visit = func(txID string) {
+		if !wanted[txID] {
+			return
+		}
+		delete(wanted, txID)
+		tx := mp[txID]
+		for _, vin := range tx.Vin {
+			visit(hex.EncodeToString(vin.Txid))
+		}
+		txs = append(txs, &tx)
+	}
+	for _, txID := range txIDs {
+		visit(txID)
+	}
+	return txs
+}
+
+// Accept adds tx to mp if it is valid on top of bc and its ancestors in
+// mp, standard and within the package limits, or returns a RejectError
+// saying why not. A transaction conflicting with ones
+// already in mp replaces them and their descendants only if every one it
+// conflicts with signals replaceability, it pays a higher fee rate than
+// each of them and a higher fee than all the transactions it evicts
+// together.
+func (mp Mempool) Accept(bc *Blockchain, tx *Transaction) error {
+	txID := hex.EncodeToString(tx.ID)
+	if _, ok := mp[txID]; ok {
+		return rejectf(RejectDuplicate, "transaction %s is already in the mempool", txID)
+	}
+	if err := CheckStandard(tx); err != nil {
+		return err
+	}
+
+	ancestors := mp.Ancestors(tx)
+	if len(ancestors)+1 > maxMempoolAncestors {
+		return rejectf(RejectNonstandard, "transaction %s has too many unconfirmed ancestors", txID)
+	}
+	for _, ancestorID := range ancestors {
+		if len(mp.Descendants([]string{ancestorID}))+1 > maxMempoolDescendants {
+			return rejectf(RejectNonstandard, "transaction %s would give %s too many descendants", txID, ancestorID)
+		}
+	}
+	if !bc.VerifyTransactions(append(mp.sorted(ancestors), tx)) {
+		return rejectf(RejectInvalid, "transaction %s is invalid", txID)
+	}
+
+	fee := mp.Fee(bc, tx)
+	if fee*feeRateSize < minRelayFeeRate*tx.Size() {
+		return rejectf(RejectInsufficientFee, "transaction %s pays a fee of %d for %d bytes, below the minimum relay fee rate of %d", txID, fee, tx.Size(), minRelayFeeRate)
+	}
+	conflicts := mp.Conflicts(tx)
+	for _, conflictID := range conflicts {
+		conflict := mp[conflictID]
+		if !conflict.SignalsReplacement() {
+			return rejectf(RejectDuplicate, "transaction %s conflicts with %s, which is not replaceable", txID, conflictID)
+		}
+		if fee*conflict.Size() <= mp.Fee(bc, &conflict)*tx.Size() {
+			return rejectf(RejectInsufficientFee, "transaction %s does not pay a higher fee rate than %s", txID, conflictID)
+		}
+	}
+
+	evicted := mp.Descendants(conflicts)
+	evictedFees := 0
+	for _, evictedID := range evicted {
+		for _, ancestorID := range ancestors {
+			if ancestorID == evictedID {
+				return rejectf(RejectInvalid, "transaction %s spends %s, which it replaces", txID, evictedID)
+			}
+		}
+		evictedTx := mp[evictedID]
+		evictedFees += mp.Fee(bc, &evictedTx)
+	}
+	if len(evicted) > 0 && fee <= evictedFees {
+		return rejectf(RejectInsufficientFee, "transaction %s pays a fee of %d, not more than the %d it replaces", txID, fee, evictedFees)
+	}
+
+	for _, evictedID := range evicted {
+		delete(mp, evictedID)
+	}
+	bc.UntrackFees(evicted)
+
+	mp[txID] = *tx
+	bc.TrackFee(tx, fee)
+	return nil
+}
+
+// RemoveBlock removes the transactions mined in block from mp, along with
+// those that conflict with them and their descendants.
+func (mp Mempool) RemoveBlock(bc *Blockchain, block *Block) {
+	var conflicts []string
+	for _, tx := range block.Transactions {
+		delete(mp, hex.EncodeToString(tx.ID))
+		if !tx.IsCoinbase() {
+			conflicts = append(conflicts, mp.Conflicts(tx)...)
+		}
+	}
+
+	evicted := mp.Descendants(conflicts)
+	for _, txID := range evicted {
+		delete(mp, txID)
+	}
+	bc.UntrackFees(evicted)
+}
+
+// validTxIDs returns the ids of the transactions in mp that are, with
+// their ancestors in mp, valid on top of bc.
+func (mp Mempool) validTxIDs(bc *Blockchain) map[string]bool {
+	valid := make(map[string]bool)
+	for txID, tx := range mp {
+		tx := tx
+		if bc.VerifyTransactions(append(mp.sorted(mp.Ancestors(&tx)), &tx)) {
+			valid[txID] = true
+		}
+	}
+	return valid
+}
+
+// BlockTemplate selects the transactions of mp to mine next by package fee
+// rate: each round takes the transaction that, together with its ancestors
+// not yet selected, pays the highest fee rate, so a child paying a high fee
+// pulls its low fee parents into the block. It returns them with parents
+// before children, and their total fee.
+func (mp Mempool) BlockTemplate(bc *Blockchain) ([]*Transaction, int) {
+	var txs []*Transaction
+	fees, size := 0, 0
+
+	valid := mp.validTxIDs(bc)
+	txFees := make(map[string]int)
+	for txID := range valid {
+		tx := mp[txID]
+		txFees[txID] = mp.Fee(bc, &tx)
+	}
+
+	selected := make(map[string]bool)
+	for {
+		var bestPackage []string
+		bestFee, bestSize := 0, 0
+
+		for txID := range valid {
+			if selected[txID] {
+				continue
+			}
+			tx := mp[txID]
+			pkg := []string{txID}
+			pkgFee, pkgSize := txFees[txID], tx.Size()
+			for _, ancestorID := range mp.Ancestors(&tx) {
+				if selected[ancestorID] {
+					continue
+				}
+				ancestor := mp[ancestorID]
+				pkg = append(pkg, ancestorID)
+				pkgFee += txFees[ancestorID]
+				pkgSize += ancestor.Size()
+			}
+
+			if bestPackage == nil || pkgFee*bestSize > bestFee*pkgSize {
+				bestPackage, bestFee, bestSize = pkg, pkgFee, pkgSize
+			}
+		}
+
+		if bestPackage == nil {
+			break
+		}
+		if size+bestSize > blockMaxSize {
+			delete(valid, bestPackage[0])
+			continue
+		}
+
+		for _, tx := range mp.sorted(bestPackage) {
+			txs = append(txs, tx)
+			selected[hex.EncodeToString(tx.ID)] = true
+		}
+		fees += bestFee
+		size += bestSize
+	}
+
+	return txs, fees
+}
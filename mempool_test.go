@@ -0,0 +1,106 @@
+package main
+
+import (
+	"encoding/hex"
+	"testing"
+)
+
+// newTestMempool returns a chain whose wallet has mined blocks blocks,
+// their coinbases, an empty mempool, and a function returning a signed
+// transaction with sequence spending the first output of each parent, on
+// the chain or in the mempool, and paying value back to the wallet.
+func newTestMempool(t *testing.T, blocks int) (*Blockchain, Mempool, []*Transaction, func(sequence uint32, value int, parents ...*Transaction) *Transaction) {
+	bc, from := newTestBlockchain(t)
+	wallets, _ := NewWallets()
+	wallet := wallets.Wallets[from]
+
+	genesis, err := bc.GetBlock(bc.tip)
+	if err != nil {
+		t.Fatal(err)
+	}
+	coinbases := []*Transaction{genesis.Transactions[0]}
+	for len(coinbases) < blocks {
+		block := bc.MineBlock([]*Transaction{NewCoinbaseTx(from, "", 0)})
+		coinbases = append(coinbases, block.Transactions[0])
+	}
+
+	mp := make(Mempool)
+	spend := func(sequence uint32, value int, parents ...*Transaction) *Transaction {
+		tx := Transaction{nil, nil, []TXOutput{*NewTXOutput(value, from)}, 0}
+		for _, parent := range parents {
+			tx.Vin = append(tx.Vin, TXInput{parent.ID, 0, nil, nil, nil, sequence})
+		}
+		tx.SetId()
+		prevOuts, err := mp.PrevOutputs(bc, &tx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tx.Sign(wallet, prevOuts)
+		return &tx
+	}
+	return bc, mp, coinbases, spend
+}
+
+func rejectCode(err error) byte {
+	if reject, ok := err.(RejectError); ok {
+		return reject.Code
+	}
+	return 0
+}
+
+// TestAcceptReplacement replaces a replaceable transaction paying a fee of
+// 2 with a child paying another 2, which needs a higher fee rate than the
+// original and a fee above the 4 they pay together.
+func TestAcceptReplacement(t *testing.T) {
+	bc, mp, coinbases, spend := newTestMempool(t, 1)
+
+	original := spend(MaxReplaceableSequence, subsidy-2, coinbases[0])
+	if err := mp.Accept(bc, original); err != nil {
+		t.Fatal(err)
+	}
+	if err := mp.Accept(bc, spend(NonReplaceableSequence, subsidy-4, original)); err != nil {
+		t.Fatal(err)
+	}
+
+	replacement := spend(NonReplaceableSequence, subsidy-5, coinbases[0])
+	tests := []struct {
+		name string
+		tx   *Transaction
+		code byte
+	}{
+		{"duplicate", original, RejectDuplicate},
+		{"same fee rate", spend(NonReplaceableSequence, subsidy-2, coinbases[0]), RejectInsufficientFee},
+		{"fee not above evicted fees", spend(MaxReplaceableSequence, subsidy-3, coinbases[0]), RejectInsufficientFee},
+		{"replacement", replacement, 0},
+		{"conflict with a non-replaceable transaction", spend(MaxReplaceableSequence, subsidy-8, coinbases[0]), RejectDuplicate},
+	}
+	for _, test := range tests {
+		if code := rejectCode(mp.Accept(bc, test.tx)); code != test.code {
+			t.Errorf("%s: reject code %#x, want %#x", test.name, code, test.code)
+		}
+	}
+
+	if _, ok := mp[hex.EncodeToString(replacement.ID)]; !ok || len(mp) != 1 {
+		t.Errorf("mempool holds %d transactions, want only the replacement", len(mp))
+	}
+}
+
+// TestAcceptAncestorLimit builds a chain of unconfirmed transactions up to
+// maxMempoolAncestors long and checks that the next one is rejected.
+func TestAcceptAncestorLimit(t *testing.T) {
+	bc, mp, coinbases, spend := newTestMempool(t, 4)
+
+	value := 4*subsidy - 2
+	tx := spend(NonReplaceableSequence, value, coinbases...)
+	for i := 0; i < maxMempoolAncestors; i++ {
+		if err := mp.Accept(bc, tx); err != nil {
+			t.Fatalf("transaction %d: %v", i+1, err)
+		}
+		value--
+		tx = spend(NonReplaceableSequence, value, tx)
+	}
+
+	if code := rejectCode(mp.Accept(bc, tx)); code != RejectNonstandard {
+		t.Errorf("transaction %d: reject code %#x, want %#x", maxMempoolAncestors+1, code, RejectNonstandard)
+	}
+}
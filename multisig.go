@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"log"
+)
+
+// MultisigTx is a transaction spending from a multisig address, passed
+// between cosigners in a file until enough of them have signed it.
+type MultisigTx struct {
+	Transaction  Transaction
+	RedeemScript []byte
+	// Signatures holds the signatures of each input keyed by the hex
+	// public key that made them.
+	Signatures []map[string][]byte
+}
+
+// NewMultisigTransaction returns an unsigned transaction paying amount
+// from the multisig address from, with redeem script redeemScript, to to.
+// Its fee is set as NewUTXOTransaction sets it, for unlocking scripts
+// holding as many signatures as redeemScript requires.
+func NewMultisigTransaction(from, to string, amount, fee, feeRate, maxFee int, redeemScript []byte, bc *Blockchain) *MultisigTx {
+	tx := fundUnsignedTransaction(from, []TXOutput{*NewTXOutput(amount, to)}, fee, feeRate, false, BranchAndBound{}, redeemScript, bc)
+	checkMaxFee(tx, maxFee, bc)
+
+	return &MultisigTx{*tx, redeemScript, make([]map[string][]byte, len(tx.Vin))}
+}
+
+// Sign adds a signature to every input for each key of the redeem script
+// held in wallets, and returns how many keys signed.
+func (mtx *MultisigTx) Sign(wallets *Wallets) int {
+	_, pubKeys, ok := extractMultisig(mtx.RedeemScript)
+	if !ok {
+		log.Panic("ERROR: Not a multisig redeem script")
+	}
+
+	signed := 0
+	for _, pubKey := range pubKeys {
+		wallet, ok := wallets.FindByPubKey(pubKey)
+		if !ok {
+			continue
+		}
+
+		for inID := range mtx.Transaction.Vin {
+			if mtx.Signatures[inID] == nil {
+				mtx.Signatures[inID] = make(map[string][]byte)
+			}
+			signature := mtx.Transaction.SignInput(wallet.PrivateKey, inID, mtx.RedeemScript, SigHashAll)
+			mtx.Signatures[inID][hex.EncodeToString(pubKey)] = signature
+		}
+		signed++
+	}
+
+	return signed
+}
+
+// Finalize sets the unlocking script of every input from the collected
+// signatures, taken in the order of the redeem script's keys.
+func (mtx *MultisigTx) Finalize() (*Transaction, error) {
+	m, pubKeys, ok := extractMultisig(mtx.RedeemScript)
+	if !ok {
+		return nil, fmt.Errorf("not a multisig redeem script")
+	}
+
+	tx := mtx.Transaction
+	tx.Vin = append([]TXInput{}, tx.Vin...)
+
+	for inID := range tx.Vin {
+		b := NewScriptBuilder()
+		count := 0
+		for _, pubKey := range pubKeys {
+			signature, ok := mtx.Signatures[inID][hex.EncodeToString(pubKey)]
+			if !ok {
+				continue
+			}
+			b.AddData(signature)
+			count++
+			if count == m {
+				break
+			}
+		}
+		if count < m {
+			return nil, fmt.Errorf("input %d has %d of %d signatures", inID, count, m)
+		}
+
+		tx.Vin[inID].ScriptSig = b.AddData(mtx.RedeemScript).Script()
+	}
+
+	return &tx, nil
+}
+
+func (mtx MultisigTx) SaveToFile(file string) {
+	err := ioutil.WriteFile(file, gobEncode(mtx), 0666)
+	if err != nil {
+		log.Panic(err)
+	}
+}
+
+func LoadMultisigTx(file string) *MultisigTx {
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	var mtx MultisigTx
+	err = gob.NewDecoder(bytes.NewReader(content)).Decode(&mtx)
+	if err != nil {
+		log.Panic(err)
+	}
+	return &mtx
+}
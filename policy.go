@@ -0,0 +1,92 @@
+package main
+
+import "fmt"
+
+// Relay policy. Transactions breaking these rules are valid in blocks but
+// are kept out of the mempool and not relayed.
+const maxStandardTxSize = 20000
+const maxStandardInputs = 100
+const maxStandardScriptSigSize = 1650
+
+// minRelayFeeRate is the lowest fee rate per feeRateSize bytes relayed,
+// and dustRelayFeeRate the rate at which outputs costing more to create
+// and spend than they are worth are dust. Values are whole coins, so a
+// lower dust rate would never find a positive output to be dust; at this
+// one outputs of a single coin are.
+const minRelayFeeRate = 1
+const dustRelayFeeRate = 5
+
+// Reject codes, sent to the peer that relayed a rejected transaction.
+const (
+	RejectInvalid         = 0x10
+	RejectDuplicate       = 0x12
+	RejectNonstandard     = 0x40
+	RejectDust            = 0x41
+	RejectInsufficientFee = 0x42
+)
+
+// RejectError is the reason a transaction was kept out of the mempool.
+type RejectError struct {
+	Code   byte
+	Reason string
+}
+
+func (e RejectError) Error() string {
+	return e.Reason
+}
+
+func rejectf(code byte, format string, a ...interface{}) error {
+	return RejectError{code, fmt.Sprintf(format, a...)}
+}
+
+// isStandardOutput reports whether out is locked by a script type the
+// node relays.
+func isStandardOutput(out *TXOutput) bool {
+	if out.ScriptPubKey == nil {
+		return true
+	}
+	if extractPubKeyHash(out.ScriptPubKey) != nil || isPayToScriptHash(out.ScriptPubKey) {
+		return true
+	}
+	data, ok := extractNullData(out.ScriptPubKey)
+	return ok && len(data) <= maxDataCarrierSize
+}
+
+// CheckStandard returns why tx breaks the relay policy, or nil. Fee rate
+// is checked once the outputs tx spends are known.
+func CheckStandard(tx *Transaction) error {
+	if tx.IsCoinbase() {
+		return rejectf(RejectInvalid, "coinbase transactions are only valid in blocks")
+	}
+	if size := tx.Size(); size > maxStandardTxSize {
+		return rejectf(RejectNonstandard, "transaction is %d bytes, the limit is %d", size, maxStandardTxSize)
+	}
+	if len(tx.Vin) > maxStandardInputs {
+		return rejectf(RejectNonstandard, "transaction has %d inputs, the limit is %d", len(tx.Vin), maxStandardInputs)
+	}
+
+	for inID, vin := range tx.Vin {
+		if size := len(vin.UnlockingScript()); size > maxStandardScriptSigSize {
+			return rejectf(RejectNonstandard, "input %d unlocking script is %d bytes, the limit is %d", inID, size, maxStandardScriptSigSize)
+		}
+	}
+
+	dataOutputs := 0
+	for outIdx, out := range tx.Vout {
+		if !isStandardOutput(&out) {
+			return rejectf(RejectNonstandard, "output %d has a non-standard locking script", outIdx)
+		}
+		if out.IsUnspendable() {
+			dataOutputs++
+			continue
+		}
+		if out.Value <= 0 || isDust(out.Value, dustRelayFeeRate) {
+			return rejectf(RejectDust, "output %d of %d is dust", outIdx, out.Value)
+		}
+	}
+	if dataOutputs > 1 {
+		return rejectf(RejectNonstandard, "transaction has %d data outputs, the limit is 1", dataOutputs)
+	}
+
+	return nil
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestCheckStandard(t *testing.T) {
+	address := "1BgGZ9tcN4rm9KBzDn7KprQz87SZ26SAMH"
+	newTx := func(change func(tx *Transaction)) *Transaction {
+		txid := bytes.Repeat([]byte{1}, 32)
+		tx := Transaction{nil, []TXInput{{txid, 0, nil, nil, []byte{OP_TRUE}, NonReplaceableSequence}}, []TXOutput{*NewTXOutput(10, address)}, 0}
+		if change != nil {
+			change(&tx)
+		}
+		tx.SetId()
+		return &tx
+	}
+
+	tests := []struct {
+		name string
+		tx   *Transaction
+		code byte
+	}{
+		{"standard", newTx(nil), 0},
+		{"data output", newTx(func(tx *Transaction) {
+			tx.Vout = append(tx.Vout, *NewDataOutput(make([]byte, maxDataCarrierSize)))
+		}), 0},
+		{"coinbase", NewCoinbaseTx(address, "", 0), RejectInvalid},
+		{"oversized", newTx(func(tx *Transaction) {
+			tx.Vin[0].ScriptSig = make([]byte, maxStandardTxSize)
+		}), RejectNonstandard},
+		{"too many inputs", newTx(func(tx *Transaction) {
+			for len(tx.Vin) <= maxStandardInputs {
+				tx.Vin = append(tx.Vin, TXInput{tx.Vin[0].Txid, len(tx.Vin), nil, nil, []byte{OP_TRUE}, NonReplaceableSequence})
+			}
+		}), RejectNonstandard},
+		{"oversized unlocking script", newTx(func(tx *Transaction) {
+			tx.Vin[0].ScriptSig = make([]byte, maxStandardScriptSigSize+1)
+		}), RejectNonstandard},
+		{"unknown locking script", newTx(func(tx *Transaction) {
+			tx.Vout[0] = TXOutput{10, nil, []byte{OP_TRUE}}
+		}), RejectNonstandard},
+		{"oversized data output", newTx(func(tx *Transaction) {
+			tx.Vout = append(tx.Vout, TXOutput{0, nil, NullDataScript(make([]byte, maxDataCarrierSize+1))})
+		}), RejectNonstandard},
+		{"two data outputs", newTx(func(tx *Transaction) {
+			tx.Vout = append(tx.Vout, *NewDataOutput([]byte{1}), *NewDataOutput([]byte{2}))
+		}), RejectNonstandard},
+		{"dust", newTx(func(tx *Transaction) {
+			tx.Vout = append(tx.Vout, *NewTXOutput(1, address))
+		}), RejectDust},
+		{"zero value", newTx(func(tx *Transaction) {
+			tx.Vout[0].Value = 0
+		}), RejectDust},
+		{"negative value", newTx(func(tx *Transaction) {
+			tx.Vout[0].Value = -10
+		}), RejectDust},
+	}
+	for _, test := range tests {
+		err := CheckStandard(test.tx)
+		if test.code == 0 {
+			if err != nil {
+				t.Errorf("%s: rejected: %v", test.name, err)
+			}
+			continue
+		}
+		if reject, ok := err.(RejectError); !ok || reject.Code != test.code {
+			t.Errorf("%s: got %v, want reject code %#x", test.name, err, test.code)
+		}
+	}
+}
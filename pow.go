@@ -8,7 +8,9 @@ import (
 	"math/big"
 )
 
-const targetBits = 20
+// targetBits is a variable only so that tests can mine quickly.
+var targetBits = 20
+
 const maxNonce = math.MaxInt64
 
 type ProofOfWork struct {
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"log"
+)
+
+// Placeholder unlocking scripts are built from the largest signature and
+// public key a signer adds, to size transactions before they are signed.
+const placeholderSignatureSize = 65
+const placeholderPubKeySize = 65
+
+// PartiallySignedTx is an unsigned transaction with everything needed to
+// sign it, so keys can stay on a machine without the chain. It is passed
+// between signers in a file, collecting signatures until it is finalized.
+type PartiallySignedTx struct {
+	Transaction Transaction
+	Inputs      []PSBTInput
+}
+
+// PSBTInput holds what signing an input needs. PrevOut is the output it
+// spends, and with RedeemScript, set for script outputs, names the keys
+// that sign it.
+type PSBTInput struct {
+	PrevOut      TXOutput
+	RedeemScript []byte
+	HashType     byte
+	// Signatures are keyed by the hex public key that made them.
+	Signatures map[string][]byte
+}
+
+// NewPartiallySignedTx returns the transaction NewUTXOTransaction would,
+// unsigned, with its inputs to be signed with hashType. redeemScript must
+// be given if from is a script address.
+func NewPartiallySignedTx(from, to string, amount, fee, feeRate, maxFee int, replaceable bool, selector CoinSelector, hashType byte, redeemScript []byte, bc *Blockchain) *PartiallySignedTx {
+	addrVersion, _ := decodeAddress([]byte(from))
+	if addrVersion == scriptVersion && redeemScript == nil {
+		log.Panicf("ERROR: No redeem script for %s", from)
+	}
+
+	tx := fundUnsignedTransaction(from, []TXOutput{*NewTXOutput(amount, to)}, fee, feeRate, replaceable, selector, redeemScript, bc)
+	checkMaxFee(tx, maxFee, bc)
+
+	prevOuts, err := bc.prevOutputs(tx)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	psbt := PartiallySignedTx{*tx, make([]PSBTInput, len(tx.Vin))}
+	for inID, vin := range tx.Vin {
+		if tx.SignatureHash(inID, redeemScript, hashType) == nil {
+			log.Panicf("ERROR: Cannot sign input %d with hash type %#x", inID, hashType)
+		}
+		prevOut := prevOuts[hex.EncodeToString(outpointKey(vin.Txid, vin.Vout))]
+		psbt.Inputs[inID] = PSBTInput{prevOut, redeemScript, hashType, make(map[string][]byte)}
+	}
+	return &psbt
+}
+
+// fundUnsignedTransaction is fundTransaction for a transaction that will
+// be signed later. Its fee is worked out with placeholder unlocking
+// scripts, which are removed before it is returned.
+func fundUnsignedTransaction(from string, payments []TXOutput, fee, feeRate int, replaceable bool, selector CoinSelector, redeemScript []byte, bc *Blockchain) *Transaction {
+	tx := fundTransaction(from, payments, fee, feeRate, replaceable, selector, redeemScript, bc, func(tx *Transaction) {
+		for inID := range tx.Vin {
+			tx.Vin[inID].ScriptSig = placeholderScriptSig(redeemScript)
+		}
+	})
+	for inID := range tx.Vin {
+		tx.Vin[inID].ScriptSig = nil
+	}
+	return tx
+}
+
+// placeholderScriptSig returns an unlocking script the size of one that
+// spends an output paying to redeemScript, or to a key if it is nil.
+func placeholderScriptSig(redeemScript []byte) []byte {
+	signature := make([]byte, placeholderSignatureSize)
+	b := NewScriptBuilder()
+
+	if m, _, ok := extractMultisig(redeemScript); ok {
+		for i := 0; i < m; i++ {
+			b.AddData(signature)
+		}
+		return b.AddData(redeemScript).Script()
+	}
+
+	b.AddData(signature).AddData(make([]byte, placeholderPubKeySize))
+	if redeemScript != nil {
+		b.AddData(redeemScript)
+	}
+	return b.Script()
+}
+
+// signers returns the wallets in wallets that can sign in: the key of a
+// pay-to-pubkey-hash output or timelock script, or the keys of a multisig.
+func (in *PSBTInput) signers(wallets *Wallets) []*Wallet {
+	var signers []*Wallet
+
+	if _, pubKeys, ok := extractMultisig(in.RedeemScript); ok {
+		for _, pubKey := range pubKeys {
+			if wallet, ok := wallets.FindByPubKey(pubKey); ok {
+				signers = append(signers, wallet)
+			}
+		}
+		return signers
+	}
+
+	pubKeyHash := in.PrevOut.AddressHash()
+	if in.RedeemScript != nil {
+		_, _, hash, ok := extractTimeLockScript(in.RedeemScript)
+		if !ok {
+			return nil
+		}
+		pubKeyHash = hash
+	}
+	if wallet, ok := wallets.Wallets[string(encodeAddress(version, pubKeyHash))]; ok {
+		signers = append(signers, wallet)
+	}
+	return signers
+}
+
+// Sign adds a signature to each input for every key in wallets that can
+// sign it, and returns how many signatures it added.
+func (psbt *PartiallySignedTx) Sign(wallets *Wallets) int {
+	signed := 0
+	for inID := range psbt.Inputs {
+		in := &psbt.Inputs[inID]
+		subscript := in.RedeemScript
+		if subscript == nil {
+			subscript = in.PrevOut.LockingScript()
+		}
+
+		for _, wallet := range in.signers(wallets) {
+			if in.Signatures == nil {
+				in.Signatures = make(map[string][]byte)
+			}
+			signature := psbt.Transaction.SignInput(wallet.PrivateKey, inID, subscript, in.HashType)
+			in.Signatures[hex.EncodeToString(wallet.PublicKey)] = signature
+			signed++
+		}
+	}
+	return signed
+}
+
+// Combine adds to psbt the signatures of other, a copy of the same
+// transaction signed elsewhere.
+func (psbt *PartiallySignedTx) Combine(other *PartiallySignedTx) error {
+	if !bytes.Equal(psbt.Transaction.ID, other.Transaction.ID) {
+		return fmt.Errorf("transaction %x is not %x", other.Transaction.ID, psbt.Transaction.ID)
+	}
+
+	for inID := range psbt.Inputs {
+		in := &psbt.Inputs[inID]
+		if in.Signatures == nil {
+			in.Signatures = make(map[string][]byte)
+		}
+		for pubKey, signature := range other.Inputs[inID].Signatures {
+			in.Signatures[pubKey] = signature
+		}
+	}
+	return nil
+}
+
+// Finalize sets the unlocking script of every input from its signatures.
+func (psbt *PartiallySignedTx) Finalize() (*Transaction, error) {
+	tx := psbt.Transaction
+	tx.Vin = append([]TXInput{}, tx.Vin...)
+
+	for inID := range psbt.Inputs {
+		scriptSig, err := psbt.Inputs[inID].unlockingScript()
+		if err != nil {
+			return nil, fmt.Errorf("input %d %v", inID, err)
+		}
+		tx.Vin[inID].ScriptSig = scriptSig
+	}
+
+	return &tx, nil
+}
+
+// unlockingScript returns the script spending in made from its signatures,
+// taken in the order of the keys of a multisig redeem script.
+func (in *PSBTInput) unlockingScript() ([]byte, error) {
+	b := NewScriptBuilder()
+
+	if m, pubKeys, ok := extractMultisig(in.RedeemScript); ok {
+		count := 0
+		for _, pubKey := range pubKeys {
+			signature, ok := in.Signatures[hex.EncodeToString(pubKey)]
+			if !ok {
+				continue
+			}
+			b.AddData(signature)
+			count++
+			if count == m {
+				break
+			}
+		}
+		if count < m {
+			return nil, fmt.Errorf("has %d of %d signatures", count, m)
+		}
+		return b.AddData(in.RedeemScript).Script(), nil
+	}
+
+	if len(in.Signatures) == 0 {
+		return nil, fmt.Errorf("is not signed")
+	}
+	for pubKey, signature := range in.Signatures {
+		key, err := hex.DecodeString(pubKey)
+		if err != nil {
+			return nil, err
+		}
+		b.AddData(signature).AddData(key)
+		break
+	}
+	if in.RedeemScript != nil {
+		b.AddData(in.RedeemScript)
+	}
+	return b.Script(), nil
+}
+
+func (psbt PartiallySignedTx) SaveToFile(file string) {
+	err := ioutil.WriteFile(file, gobEncode(psbt), 0666)
+	if err != nil {
+		log.Panic(err)
+	}
+}
+
+func LoadPartiallySignedTx(file string) *PartiallySignedTx {
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	var psbt PartiallySignedTx
+	err = gob.NewDecoder(bytes.NewReader(content)).Decode(&psbt)
+	if err != nil {
+		log.Panic(err)
+	}
+	return &psbt
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"encoding/hex"
+	"log"
+)
+
+// RawTxInput names an output for createrawtransaction to spend. Sequence
+// defaults to that of a wallet transaction.
+type RawTxInput struct {
+	Txid     string  `json:"txid"`
+	Vout     int     `json:"vout"`
+	Sequence *uint32 `json:"sequence,omitempty"`
+}
+
+// NewRawTransaction returns an unsigned transaction spending inputs and
+// making payments, in order, without looking at the chain.
+func NewRawTransaction(inputs []RawTxInput, payments []Payment, lockTime uint32, replaceable bool) *Transaction {
+	sequence := uint32(NonReplaceableSequence)
+	if replaceable {
+		sequence = MaxReplaceableSequence
+	}
+
+	var vin []TXInput
+	for _, input := range inputs {
+		txid, err := hex.DecodeString(input.Txid)
+		if err != nil {
+			log.Panic(err)
+		}
+		in := TXInput{txid, input.Vout, nil, nil, nil, sequence}
+		if input.Sequence != nil {
+			in.Sequence = *input.Sequence
+		}
+		vin = append(vin, in)
+	}
+
+	var vout []TXOutput
+	for _, payment := range payments {
+		vout = append(vout, *NewTXOutput(payment.Amount, payment.Address))
+	}
+
+	tx := Transaction{nil, vin, vout, lockTime}
+	tx.SetId()
+	return &tx
+}
+
+// DecodeRawTransaction returns the transaction serialized in hex.
+func DecodeRawTransaction(rawTx string) *Transaction {
+	data, err := hex.DecodeString(rawTx)
+	if err != nil {
+		log.Panic(err)
+	}
+	tx := DeserializeTransaction(data)
+	return &tx
+}
+
+// SignRawTransaction signs every input of tx that keys in wallets can
+// spend alone, with hashType, given the outputs it spends. Inputs paying
+// to scripts need their redeem script in wallets. It reports whether every
+// input now has an unlocking script.
+func SignRawTransaction(tx *Transaction, wallets *Wallets, hashType byte, prevOuts map[string]TXOutput) bool {
+	psbt := PartiallySignedTx{*tx, make([]PSBTInput, len(tx.Vin))}
+	for inID, vin := range tx.Vin {
+		prevOut := prevOuts[hex.EncodeToString(outpointKey(vin.Txid, vin.Vout))]
+		var redeemScript []byte
+		if scriptHash := extractScriptHash(prevOut.LockingScript()); scriptHash != nil {
+			redeemScript = wallets.Scripts[string(encodeAddress(scriptVersion, scriptHash))]
+		}
+		psbt.Inputs[inID] = PSBTInput{prevOut, redeemScript, hashType, nil}
+	}
+	psbt.Sign(wallets)
+
+	complete := true
+	for inID := range tx.Vin {
+		scriptSig, err := psbt.Inputs[inID].unlockingScript()
+		if err == nil {
+			tx.Vin[inID].ScriptSig = scriptSig
+		}
+		if tx.Vin[inID].ScriptSig == nil {
+			complete = false
+		}
+	}
+	return complete
+}
+
+type decodedTx struct {
+	Txid        string          `json:"txid"`
+	Size        int             `json:"size"`
+	LockTime    uint32          `json:"locktime"`
+	Replaceable bool            `json:"replaceable"`
+	Vin         []decodedInput  `json:"vin"`
+	Vout        []decodedOutput `json:"vout"`
+}
+
+type decodedInput struct {
+	Coinbase  string         `json:"coinbase,omitempty"`
+	Txid      string         `json:"txid,omitempty"`
+	Vout      int            `json:"vout"`
+	ScriptSig *decodedScript `json:"scriptSig,omitempty"`
+	Sequence  uint32         `json:"sequence"`
+}
+
+type decodedOutput struct {
+	Value        int           `json:"value"`
+	N            int           `json:"n"`
+	ScriptPubKey decodedScript `json:"scriptPubKey"`
+}
+
+type decodedScript struct {
+	Asm     string `json:"asm"`
+	Hex     string `json:"hex"`
+	Type    string `json:"type,omitempty"`
+	Address string `json:"address,omitempty"`
+}
+
+// DecodeTransaction returns tx in the form decoderawtransaction prints.
+func DecodeTransaction(tx *Transaction) decodedTx {
+	decoded := decodedTx{
+		Txid:        hex.EncodeToString(tx.ID),
+		Size:        tx.Size(),
+		LockTime:    tx.LockTime,
+		Replaceable: tx.SignalsReplacement(),
+	}
+
+	for _, vin := range tx.Vin {
+		if tx.IsCoinbase() {
+			decoded.Vin = append(decoded.Vin, decodedInput{Coinbase: hex.EncodeToString(vin.PubKey), Vout: vin.Vout, Sequence: vin.Sequence})
+			continue
+		}
+
+		in := decodedInput{Txid: hex.EncodeToString(vin.Txid), Vout: vin.Vout, Sequence: vin.Sequence}
+		if vin.ScriptSig != nil || vin.Signature != nil {
+			script := vin.UnlockingScript()
+			in.ScriptSig = &decodedScript{Asm: DisasmScript(script), Hex: hex.EncodeToString(script)}
+		}
+		decoded.Vin = append(decoded.Vin, in)
+	}
+
+	for n, out := range tx.Vout {
+		script := out.LockingScript()
+		scriptType, address := "nonstandard", ""
+		if pubKeyHash := extractPubKeyHash(script); pubKeyHash != nil {
+			scriptType, address = "pubkeyhash", string(encodeAddress(version, pubKeyHash))
+		} else if scriptHash := extractScriptHash(script); scriptHash != nil {
+			scriptType, address = "scripthash", string(encodeAddress(scriptVersion, scriptHash))
+		} else if _, ok := extractNullData(script); ok {
+			scriptType = "nulldata"
+		}
+
+		decoded.Vout = append(decoded.Vout, decodedOutput{out.Value, n, decodedScript{DisasmScript(script), hex.EncodeToString(script), scriptType, address}})
+	}
+
+	return decoded
+}
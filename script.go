@@ -0,0 +1,446 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+)
+
+const (
+	OP_0                   = 0x00
+	OP_FALSE               = OP_0
+	OP_PUSHDATA1           = 0x4c
+	OP_PUSHDATA2           = 0x4d
+	OP_PUSHDATA4           = 0x4e
+	OP_1NEGATE             = 0x4f
+	OP_1                   = 0x51
+	OP_TRUE                = OP_1
+	OP_16                  = 0x60
+	OP_NOP                 = 0x61
+	OP_IF                  = 0x63
+	OP_NOTIF               = 0x64
+	OP_ELSE                = 0x67
+	OP_ENDIF               = 0x68
+	OP_VERIFY              = 0x69
+	OP_RETURN              = 0x6a
+	OP_TOALTSTACK          = 0x6b
+	OP_FROMALTSTACK        = 0x6c
+	OP_2DROP               = 0x6d
+	OP_2DUP                = 0x6e
+	OP_IFDUP               = 0x73
+	OP_DEPTH               = 0x74
+	OP_DROP                = 0x75
+	OP_DUP                 = 0x76
+	OP_NIP                 = 0x77
+	OP_OVER                = 0x78
+	OP_ROT                 = 0x7b
+	OP_SWAP                = 0x7c
+	OP_SIZE                = 0x82
+	OP_EQUAL               = 0x87
+	OP_EQUALVERIFY         = 0x88
+	OP_1ADD                = 0x8b
+	OP_1SUB                = 0x8c
+	OP_NOT                 = 0x91
+	OP_0NOTEQUAL           = 0x92
+	OP_ADD                 = 0x93
+	OP_SUB                 = 0x94
+	OP_BOOLAND             = 0x9a
+	OP_BOOLOR              = 0x9b
+	OP_NUMEQUAL            = 0x9c
+	OP_NUMEQUALVERIFY      = 0x9d
+	OP_LESSTHAN            = 0x9f
+	OP_GREATERTHAN         = 0xa0
+	OP_MIN                 = 0xa3
+	OP_MAX                 = 0xa4
+	OP_WITHIN              = 0xa5
+	OP_RIPEMD160           = 0xa6
+	OP_SHA256              = 0xa8
+	OP_HASH160             = 0xa9
+	OP_HASH256             = 0xaa
+	OP_CHECKSIG            = 0xac
+	OP_CHECKSIGVERIFY      = 0xad
+	OP_CHECKMULTISIG       = 0xae
+	OP_CHECKMULTISIGVERIFY = 0xaf
+	OP_CHECKLOCKTIMEVERIFY = 0xb1
+	OP_CHECKSEQUENCEVERIFY = 0xb2
+)
+
+var opcodeNames = map[byte]string{
+	OP_0:                   "0",
+	OP_1NEGATE:             "-1",
+	OP_NOP:                 "OP_NOP",
+	OP_IF:                  "OP_IF",
+	OP_NOTIF:               "OP_NOTIF",
+	OP_ELSE:                "OP_ELSE",
+	OP_ENDIF:               "OP_ENDIF",
+	OP_VERIFY:              "OP_VERIFY",
+	OP_RETURN:              "OP_RETURN",
+	OP_TOALTSTACK:          "OP_TOALTSTACK",
+	OP_FROMALTSTACK:        "OP_FROMALTSTACK",
+	OP_2DROP:               "OP_2DROP",
+	OP_2DUP:                "OP_2DUP",
+	OP_IFDUP:               "OP_IFDUP",
+	OP_DEPTH:               "OP_DEPTH",
+	OP_DROP:                "OP_DROP",
+	OP_DUP:                 "OP_DUP",
+	OP_NIP:                 "OP_NIP",
+	OP_OVER:                "OP_OVER",
+	OP_ROT:                 "OP_ROT",
+	OP_SWAP:                "OP_SWAP",
+	OP_SIZE:                "OP_SIZE",
+	OP_EQUAL:               "OP_EQUAL",
+	OP_EQUALVERIFY:         "OP_EQUALVERIFY",
+	OP_1ADD:                "OP_1ADD",
+	OP_1SUB:                "OP_1SUB",
+	OP_NOT:                 "OP_NOT",
+	OP_0NOTEQUAL:           "OP_0NOTEQUAL",
+	OP_ADD:                 "OP_ADD",
+	OP_SUB:                 "OP_SUB",
+	OP_BOOLAND:             "OP_BOOLAND",
+	OP_BOOLOR:              "OP_BOOLOR",
+	OP_NUMEQUAL:            "OP_NUMEQUAL",
+	OP_NUMEQUALVERIFY:      "OP_NUMEQUALVERIFY",
+	OP_LESSTHAN:            "OP_LESSTHAN",
+	OP_GREATERTHAN:         "OP_GREATERTHAN",
+	OP_MIN:                 "OP_MIN",
+	OP_MAX:                 "OP_MAX",
+	OP_WITHIN:              "OP_WITHIN",
+	OP_RIPEMD160:           "OP_RIPEMD160",
+	OP_SHA256:              "OP_SHA256",
+	OP_HASH160:             "OP_HASH160",
+	OP_HASH256:             "OP_HASH256",
+	OP_CHECKSIG:            "OP_CHECKSIG",
+	OP_CHECKSIGVERIFY:      "OP_CHECKSIGVERIFY",
+	OP_CHECKMULTISIG:       "OP_CHECKMULTISIG",
+	OP_CHECKMULTISIGVERIFY: "OP_CHECKMULTISIGVERIFY",
+	OP_CHECKLOCKTIMEVERIFY: "OP_CHECKLOCKTIMEVERIFY",
+	OP_CHECKSEQUENCEVERIFY: "OP_CHECKSEQUENCEVERIFY",
+}
+
+// scriptOp is a parsed script instruction. data is set for pushes.
+type scriptOp struct {
+	opcode byte
+	data   []byte
+}
+
+var errMalformedPush = errors.New("script: malformed push")
+
+// parseScript splits script into instructions.
+func parseScript(script []byte) ([]scriptOp, error) {
+	var ops []scriptOp
+
+	for i := 0; i < len(script); {
+		op := script[i]
+		i++
+
+		var n int
+		switch {
+		case op > OP_0 && op < OP_PUSHDATA1:
+			n = int(op)
+		case op == OP_PUSHDATA1:
+			if i+1 > len(script) {
+				return nil, errMalformedPush
+			}
+			n = int(script[i])
+			i++
+		case op == OP_PUSHDATA2:
+			if i+2 > len(script) {
+				return nil, errMalformedPush
+			}
+			n = int(binary.LittleEndian.Uint16(script[i:]))
+			i += 2
+		case op == OP_PUSHDATA4:
+			if i+4 > len(script) {
+				return nil, errMalformedPush
+			}
+			n = int(binary.LittleEndian.Uint32(script[i:]))
+			i += 4
+		default:
+			ops = append(ops, scriptOp{op, nil})
+			continue
+		}
+
+		if n < 0 || i+n > len(script) {
+			return nil, errMalformedPush
+		}
+		ops = append(ops, scriptOp{op, script[i : i+n]})
+		i += n
+	}
+
+	return ops, nil
+}
+
+// DisasmScript returns script as a line of opcode names, small integers
+// and hex pushed data, or [error] if it cannot be parsed.
+func DisasmScript(script []byte) string {
+	ops, err := parseScript(script)
+	if err != nil {
+		return "[error]"
+	}
+
+	var words []string
+	for _, op := range ops {
+		name, ok := opcodeNames[op.opcode]
+		switch {
+		case op.data != nil:
+			words = append(words, hex.EncodeToString(op.data))
+		case smallInt(op) > 0:
+			words = append(words, fmt.Sprint(smallInt(op)))
+		case ok:
+			words = append(words, name)
+		default:
+			words = append(words, fmt.Sprintf("OP_UNKNOWN<%#x>", op.opcode))
+		}
+	}
+	return strings.Join(words, " ")
+}
+
+func isPushOnly(ops []scriptOp) bool {
+	for _, op := range ops {
+		if op.opcode > OP_16 {
+			return false
+		}
+	}
+	return true
+}
+
+type ScriptBuilder struct {
+	script []byte
+}
+
+func NewScriptBuilder() *ScriptBuilder {
+	return &ScriptBuilder{}
+}
+
+func (b *ScriptBuilder) AddOp(op byte) *ScriptBuilder {
+	b.script = append(b.script, op)
+	return b
+}
+
+// AddData appends the smallest push of data.
+func (b *ScriptBuilder) AddData(data []byte) *ScriptBuilder {
+	n := len(data)
+	switch {
+	case n == 0:
+		b.script = append(b.script, OP_0)
+		return b
+	case n == 1 && data[0] >= 1 && data[0] <= 16:
+		b.script = append(b.script, OP_1-1+data[0])
+		return b
+	case n < OP_PUSHDATA1:
+		b.script = append(b.script, byte(n))
+	case n <= 0xff:
+		b.script = append(b.script, OP_PUSHDATA1, byte(n))
+	case n <= 0xffff:
+		b.script = append(b.script, OP_PUSHDATA2, 0, 0)
+		binary.LittleEndian.PutUint16(b.script[len(b.script)-2:], uint16(n))
+	default:
+		b.script = append(b.script, OP_PUSHDATA4, 0, 0, 0, 0)
+		binary.LittleEndian.PutUint32(b.script[len(b.script)-4:], uint32(n))
+	}
+	b.script = append(b.script, data...)
+	return b
+}
+
+func (b *ScriptBuilder) AddInt(n int64) *ScriptBuilder {
+	if n == 0 {
+		return b.AddOp(OP_0)
+	}
+	if n == -1 {
+		return b.AddOp(OP_1NEGATE)
+	}
+	if n >= 1 && n <= 16 {
+		return b.AddOp(byte(OP_1 - 1 + n))
+	}
+	b.script = append(b.script, byte(len(scriptNum(n).Bytes())))
+	b.script = append(b.script, scriptNum(n).Bytes()...)
+	return b
+}
+
+func (b *ScriptBuilder) Script() []byte {
+	return b.script
+}
+
+// PayToPubKeyHashScript locks an output to the key hashing to pubKeyHash.
+func PayToPubKeyHashScript(pubKeyHash []byte) []byte {
+	return NewScriptBuilder().AddOp(OP_DUP).AddOp(OP_HASH160).AddData(pubKeyHash).
+		AddOp(OP_EQUALVERIFY).AddOp(OP_CHECKSIG).Script()
+}
+
+// extractPubKeyHash returns the key hash of a pay-to-pubkey-hash script,
+// or nil if script is of another form.
+func extractPubKeyHash(script []byte) []byte {
+	if len(script) == 25 && script[0] == OP_DUP && script[1] == OP_HASH160 && script[2] == 20 &&
+		script[23] == OP_EQUALVERIFY && script[24] == OP_CHECKSIG {
+		return script[3:23]
+	}
+	return nil
+}
+
+// NullDataScript returns a provably unspendable script carrying data.
+func NullDataScript(data []byte) []byte {
+	return NewScriptBuilder().AddOp(OP_RETURN).AddData(data).Script()
+}
+
+// extractNullData returns the data carried by a script made by
+// NullDataScript.
+func extractNullData(script []byte) ([]byte, bool) {
+	ops, err := parseScript(script)
+	if err != nil || len(ops) != 2 || ops[0].opcode != OP_RETURN || ops[1].opcode > OP_PUSHDATA4 {
+		return nil, false
+	}
+	return ops[1].data, true
+}
+
+// PayToScriptHashScript locks an output to the redeem script hashing to
+// scriptHash.
+func PayToScriptHashScript(scriptHash []byte) []byte {
+	return NewScriptBuilder().AddOp(OP_HASH160).AddData(scriptHash).AddOp(OP_EQUAL).Script()
+}
+
+func isPayToScriptHash(script []byte) bool {
+	return len(script) == 23 && script[0] == OP_HASH160 && script[1] == 20 && script[22] == OP_EQUAL
+}
+
+// extractScriptHash returns the script hash of a pay-to-script-hash
+// script, or nil if script is of another form.
+func extractScriptHash(script []byte) []byte {
+	if isPayToScriptHash(script) {
+		return script[2:22]
+	}
+	return nil
+}
+
+// MultisigScript returns a redeem script that needs signatures from m of
+// pubKeys, given in the same order as the keys.
+func MultisigScript(m int, pubKeys [][]byte) []byte {
+	if m < 1 || m > len(pubKeys) || len(pubKeys) > maxPubKeysPerMultisig {
+		log.Panicf("ERROR: Invalid %d-of-%d multisig", m, len(pubKeys))
+	}
+
+	b := NewScriptBuilder().AddInt(int64(m))
+	for _, pubKey := range pubKeys {
+		b.AddData(pubKey)
+	}
+	return b.AddInt(int64(len(pubKeys))).AddOp(OP_CHECKMULTISIG).Script()
+}
+
+// extractMultisig returns the required signature count and the public
+// keys of a script made by MultisigScript.
+func extractMultisig(script []byte) (int, [][]byte, bool) {
+	ops, err := parseScript(script)
+	if err != nil || len(ops) < 4 || ops[len(ops)-1].opcode != OP_CHECKMULTISIG {
+		return 0, nil, false
+	}
+
+	m := smallInt(ops[0])
+	n := smallInt(ops[len(ops)-2])
+	if m < 1 || n != len(ops)-3 || m > n {
+		return 0, nil, false
+	}
+
+	var pubKeys [][]byte
+	for _, op := range ops[1 : len(ops)-2] {
+		if op.data == nil {
+			return 0, nil, false
+		}
+		pubKeys = append(pubKeys, op.data)
+	}
+	return m, pubKeys, true
+}
+
+// smallInt returns the value pushed by OP_1 to OP_16, or -1.
+func smallInt(op scriptOp) int {
+	if op.opcode < OP_1 || op.opcode > OP_16 {
+		return -1
+	}
+	return int(op.opcode-OP_1) + 1
+}
+
+// TimeLockScript returns a redeem script that lets the key hashing to
+// pubKeyHash spend once op, OP_CHECKLOCKTIMEVERIFY or
+// OP_CHECKSEQUENCEVERIFY, accepts lock.
+func TimeLockScript(op byte, lock int64, pubKeyHash []byte) []byte {
+	b := NewScriptBuilder().AddInt(lock).AddOp(op).AddOp(OP_DROP)
+	return append(b.Script(), PayToPubKeyHashScript(pubKeyHash)...)
+}
+
+// extractTimeLockScript returns the opcode, lock and key hash of a script
+// made by TimeLockScript.
+func extractTimeLockScript(script []byte) (byte, int64, []byte, bool) {
+	ops, err := parseScript(script)
+	if err != nil || len(ops) != 8 || len(script) < 25 || ops[2].opcode != OP_DROP {
+		return 0, 0, nil, false
+	}
+	op := ops[1].opcode
+	if op != OP_CHECKLOCKTIMEVERIFY && op != OP_CHECKSEQUENCEVERIFY {
+		return 0, 0, nil, false
+	}
+	pubKeyHash := extractPubKeyHash(script[len(script)-25:])
+	if pubKeyHash == nil {
+		return 0, 0, nil, false
+	}
+
+	lock, ok := lockValue(ops[0])
+	if !ok {
+		return 0, 0, nil, false
+	}
+	return op, lock, pubKeyHash, true
+}
+
+// lockValue returns the locktime or sequence pushed by op.
+func lockValue(op scriptOp) (int64, bool) {
+	if n := smallInt(op); n >= 0 {
+		return int64(n), true
+	}
+	n, err := makeScriptNum(op.data, maxLockTimeNumLen)
+	return int64(n), err == nil
+}
+
+// AtomicSwapScript returns a redeem script that pays to the key hashing to
+// recipientHash given the 32 byte preimage of secretHash, or to the key
+// hashing to refundHash once lockTime has passed.
+func AtomicSwapScript(recipientHash, refundHash []byte, lockTime int64, secretHash []byte) []byte {
+	return NewScriptBuilder().
+		AddOp(OP_IF).
+		AddOp(OP_SIZE).AddInt(swapSecretSize).AddOp(OP_EQUALVERIFY).
+		AddOp(OP_SHA256).AddData(secretHash).AddOp(OP_EQUALVERIFY).
+		AddOp(OP_DUP).AddOp(OP_HASH160).AddData(recipientHash).
+		AddOp(OP_ELSE).
+		AddInt(lockTime).AddOp(OP_CHECKLOCKTIMEVERIFY).AddOp(OP_DROP).
+		AddOp(OP_DUP).AddOp(OP_HASH160).AddData(refundHash).
+		AddOp(OP_ENDIF).
+		AddOp(OP_EQUALVERIFY).AddOp(OP_CHECKSIG).
+		Script()
+}
+
+// AtomicSwapContract holds the terms of a script made by AtomicSwapScript.
+type AtomicSwapContract struct {
+	RecipientHash []byte
+	RefundHash    []byte
+	LockTime      int64
+	SecretHash    []byte
+}
+
+func extractAtomicSwapScript(script []byte) (AtomicSwapContract, bool) {
+	var contract AtomicSwapContract
+
+	ops, err := parseScript(script)
+	if err != nil || len(ops) != 20 {
+		return contract, false
+	}
+	lockTime, ok := lockValue(ops[11])
+	if !ok {
+		return contract, false
+	}
+
+	contract = AtomicSwapContract{ops[9].data, ops[16].data, lockTime, ops[5].data}
+	if !bytes.Equal(script, AtomicSwapScript(contract.RecipientHash, contract.RefundHash, contract.LockTime, contract.SecretHash)) {
+		return contract, false
+	}
+	return contract, true
+}
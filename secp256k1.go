@@ -0,0 +1,172 @@
+package main
+
+import (
+	"crypto/elliptic"
+	"crypto/subtle"
+	"math/big"
+)
+
+// koblitzCurve is secp256k1, the curve y² = x³ + 7. crypto/elliptic only
+// does arithmetic on curves with a = -3, so it is done here, on field
+// elements in constant time and in projective coordinates with the
+// complete addition formulas of Renes, Costello and Batina, which need no
+// branches for doubling or the point at infinity. Affine points are given
+// as big.Ints, with the point at infinity as (0, 0).
+type koblitzCurve struct {
+	params *elliptic.CurveParams
+	fp     *montField
+	// b3 is 3b, as the addition formulas use it.
+	b3 fieldElement
+}
+
+var secp256k1 = newSecp256k1()
+
+func newSecp256k1() *koblitzCurve {
+	params := &elliptic.CurveParams{Name: "secp256k1", BitSize: 256}
+	params.P, _ = new(big.Int).SetString("FFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFEFFFFFC2F", 16)
+	params.N, _ = new(big.Int).SetString("FFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFEBAAEDCE6AF48A03BBFD25E8CD0364141", 16)
+	params.B = big.NewInt(7)
+	params.Gx, _ = new(big.Int).SetString("79BE667EF9DCBBAC55A06295CE870B07029BFCDB2DCE28D959F2815B16F81798", 16)
+	params.Gy, _ = new(big.Int).SetString("483ADA7726A3C4655DA4FBFC0E1108A8FD17B448A68554199C47D08FFB10D4B8", 16)
+	fp := newMontField(params.P)
+	return &koblitzCurve{params, fp, fp.fromBig(big.NewInt(21))}
+}
+
+func (c *koblitzCurve) Params() *elliptic.CurveParams {
+	return c.params
+}
+
+// polynomial returns x³ + 7 mod p.
+func (c *koblitzCurve) polynomial(x *big.Int) *big.Int {
+	y2 := new(big.Int).Exp(x, big.NewInt(3), c.params.P)
+	y2.Add(y2, c.params.B)
+	return y2.Mod(y2, c.params.P)
+}
+
+func (c *koblitzCurve) IsOnCurve(x, y *big.Int) bool {
+	p := c.params.P
+	if x.Sign() < 0 || x.Cmp(p) >= 0 || y.Sign() < 0 || y.Cmp(p) >= 0 {
+		return false
+	}
+	y2 := new(big.Int).Mul(y, y)
+	return y2.Mod(y2, p).Cmp(c.polynomial(x)) == 0
+}
+
+// projectivePoint is the affine point (x/z, y/z), or the point at
+// infinity if z is 0.
+type projectivePoint struct {
+	x, y, z fieldElement
+}
+
+func (c *koblitzCurve) infinity() projectivePoint {
+	return projectivePoint{y: c.fp.one()}
+}
+
+func (c *koblitzCurve) fromAffine(x, y *big.Int) projectivePoint {
+	p := projectivePoint{c.fp.fromBig(x), c.fp.fromBig(y), c.fp.one()}
+	return selectPoint(isZero(p.x)&isZero(p.y), c.infinity(), p)
+}
+
+func (c *koblitzCurve) toAffine(p projectivePoint) (*big.Int, *big.Int) {
+	zInv := c.fp.inverse(p.z)
+	return c.fp.toBig(c.fp.mul(p.x, zInv)), c.fp.toBig(c.fp.mul(p.y, zInv))
+}
+
+// selectPoint returns p if cond is 1 and q if it is 0.
+func selectPoint(cond uint64, p, q projectivePoint) projectivePoint {
+	return projectivePoint{
+		selectElement(cond, p.x, q.x),
+		selectElement(cond, p.y, q.y),
+		selectElement(cond, p.z, q.z),
+	}
+}
+
+// add returns p + q by algorithm 7 of "Complete addition formulas for
+// prime order elliptic curves", for any p and q, equal or not.
+func (c *koblitzCurve) add(p, q projectivePoint) projectivePoint {
+	f := c.fp
+	t0 := f.mul(p.x, q.x)
+	t1 := f.mul(p.y, q.y)
+	t2 := f.mul(p.z, q.z)
+	t3 := f.mul(f.add(p.x, p.y), f.add(q.x, q.y))
+	t3 = f.sub(t3, f.add(t0, t1))
+	t4 := f.mul(f.add(p.y, p.z), f.add(q.y, q.z))
+	t4 = f.sub(t4, f.add(t1, t2))
+	y3 := f.mul(f.add(p.x, p.z), f.add(q.x, q.z))
+	y3 = f.sub(y3, f.add(t0, t2))
+	t0 = f.add(f.add(t0, t0), t0)
+	t2 = f.mul(c.b3, t2)
+	z3 := f.add(t1, t2)
+	t1 = f.sub(t1, t2)
+	y3 = f.mul(c.b3, y3)
+	x3 := f.sub(f.mul(t3, t1), f.mul(t4, y3))
+	y3 = f.add(f.mul(t1, z3), f.mul(y3, t0))
+	z3 = f.add(f.mul(z3, t4), f.mul(t0, t3))
+	return projectivePoint{x3, y3, z3}
+}
+
+func (c *koblitzCurve) Add(x1, y1, x2, y2 *big.Int) (*big.Int, *big.Int) {
+	return c.toAffine(c.add(c.fromAffine(x1, y1), c.fromAffine(x2, y2)))
+}
+
+func (c *koblitzCurve) Double(x1, y1 *big.Int) (*big.Int, *big.Int) {
+	p := c.fromAffine(x1, y1)
+	return c.toAffine(c.add(p, p))
+}
+
+// ScalarMult takes the big-endian k four bits at a time, looking up the
+// multiple of the point for them without branching on their value. k is
+// padded to the size of the order, so that short scalars, as
+// ecdsa.GenerateKey passes, take as long as any other.
+func (c *koblitzCurve) ScalarMult(x1, y1 *big.Int, k []byte) (*big.Int, *big.Int) {
+	if size := (c.params.N.BitLen() + 7) / 8; len(k) < size {
+		k = append(make([]byte, size-len(k)), k...)
+	}
+
+	var table [16]projectivePoint
+	table[0] = c.infinity()
+	table[1] = c.fromAffine(x1, y1)
+	for i := 2; i < len(table); i++ {
+		table[i] = c.add(table[i-1], table[1])
+	}
+
+	q := table[0]
+	for _, b := range k {
+		for _, w := range [2]byte{b >> 4, b & 0x0f} {
+			for i := 0; i < 4; i++ {
+				q = c.add(q, q)
+			}
+			var multiple projectivePoint
+			for i := range table {
+				multiple = selectPoint(uint64(subtle.ConstantTimeByteEq(byte(i), w)), table[i], multiple)
+			}
+			q = c.add(q, multiple)
+		}
+	}
+	return c.toAffine(q)
+}
+
+func (c *koblitzCurve) ScalarBaseMult(k []byte) (*big.Int, *big.Int) {
+	return c.ScalarMult(c.params.Gx, c.params.Gy, k)
+}
+
+// unmarshalCompressed decodes a SEC1 compressed point, or returns nil if
+// it is not one on the curve.
+func (c *koblitzCurve) unmarshalCompressed(data []byte) (*big.Int, *big.Int) {
+	byteLen := (c.params.BitSize + 7) / 8
+	if len(data) != 1+byteLen || (data[0] != 0x02 && data[0] != 0x03) {
+		return nil, nil
+	}
+	x := new(big.Int).SetBytes(data[1:])
+	if x.Cmp(c.params.P) >= 0 {
+		return nil, nil
+	}
+	y := new(big.Int).ModSqrt(c.polynomial(x), c.params.P)
+	if y == nil {
+		return nil, nil
+	}
+	if byte(y.Bit(0)) != data[0]&1 {
+		y.Sub(c.params.P, y)
+	}
+	return x, y
+}
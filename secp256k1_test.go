@@ -0,0 +1,79 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/sha256"
+	"math/big"
+	"testing"
+)
+
+func TestSecp256k1ScalarBaseMult(t *testing.T) {
+	n := secp256k1.params.N
+	p := secp256k1.params.P
+	tests := []struct {
+		k    string
+		x, y string
+	}{
+		{"1",
+			"79BE667EF9DCBBAC55A06295CE870B07029BFCDB2DCE28D959F2815B16F81798",
+			"483ADA7726A3C4655DA4FBFC0E1108A8FD17B448A68554199C47D08FFB10D4B8"},
+		{"2",
+			"C6047F9441ED7D6D3045406E95C07CD85C778E4B8CEF3CA7ABAC09B95C709EE5",
+			"1AE168FEA63DC339A3C58419466CEAEEF7F632653266D0E1236431A950CFE52A"},
+		{"3",
+			"F9308A019258C31049344F85F89D5229B531C845836F99B08601F113BCE036F9",
+			"388F7B0F632DE8140FE337E62A37F3566500A99934C2231B6CB9FD7584B8E672"},
+		{"AA5E28D6A97A2479A65527F7290311A3624D4CC0FA1578598EE3C2613BF99522",
+			"34F9460F0E4F08393D192B3C5133A6BA099AA0AD9FD54EBCCFACDFA239FF49C6",
+			"0B71EA9BD730FD8923F6D25A7A91E7DD7728A960686CB5A901BB419E0F2CA232"},
+		{new(big.Int).Sub(n, big.NewInt(1)).Text(16),
+			"79BE667EF9DCBBAC55A06295CE870B07029BFCDB2DCE28D959F2815B16F81798",
+			new(big.Int).Sub(p, secp256k1.params.Gy).Text(16)},
+		{n.Text(16), "0", "0"},
+		{"0", "0", "0"},
+	}
+	for _, test := range tests {
+		k := hexInt(t, test.k)
+		x, y := secp256k1.ScalarBaseMult(k.Bytes())
+		if x.Cmp(hexInt(t, test.x)) != 0 || y.Cmp(hexInt(t, test.y)) != 0 {
+			t.Errorf("%s·G = (%x, %x), want (%s, %s)", test.k, x, y, test.x, test.y)
+		}
+	}
+}
+
+func TestSecp256k1Add(t *testing.T) {
+	gx, gy := secp256k1.params.Gx, secp256k1.params.Gy
+	x2, y2 := secp256k1.Double(gx, gy)
+	x3, y3 := secp256k1.Add(x2, y2, gx, gy)
+	wantX, wantY := secp256k1.ScalarBaseMult([]byte{3})
+	if x3.Cmp(wantX) != 0 || y3.Cmp(wantY) != 0 {
+		t.Errorf("2G + G = (%x, %x), want (%x, %x)", x3, y3, wantX, wantY)
+	}
+
+	x, y := secp256k1.Add(gx, gy, new(big.Int), new(big.Int))
+	if x.Cmp(gx) != 0 || y.Cmp(gy) != 0 {
+		t.Errorf("G + 0 = (%x, %x), want G", x, y)
+	}
+	x, y = secp256k1.Add(gx, gy, gx, new(big.Int).Sub(secp256k1.params.P, gy))
+	if x.Sign() != 0 || y.Sign() != 0 {
+		t.Errorf("G - G = (%x, %x), want (0, 0)", x, y)
+	}
+}
+
+// TestSecp256k1Sign checks the signature with private key 1 of the
+// SHA-256 hash of "Satoshi Nakamoto" that other RFC 6979 implementations
+// make, and that it verifies.
+func TestSecp256k1Sign(t *testing.T) {
+	key := testKey(t, secp256k1, "1")
+	hash := sha256.Sum256([]byte("Satoshi Nakamoto"))
+	signature := signHash(key, hash[:])
+
+	r := hexInt(t, "934B1EA10A4B3C1757E2B0C017D0B6143CE3C9A7E6A4A49860D7A6AB210EE3D8")
+	s := hexInt(t, "2442CE9D2B916064108014783E923EC36B49743E2FFA1C4496F01A512AAFD9E5")
+	if new(big.Int).SetBytes(signature[:32]).Cmp(r) != 0 || new(big.Int).SetBytes(signature[32:]).Cmp(s) != 0 {
+		t.Errorf("signature = %x, want %064x%064x", signature, r, s)
+	}
+	if !ecdsa.Verify(&key.PublicKey, hash[:], r, s) {
+		t.Error("signature does not verify")
+	}
+}
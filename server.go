@@ -9,17 +9,23 @@ import (
 	"io/ioutil"
 	"log"
 	"net"
+	"os"
+	"os/signal"
+	"syscall"
 )
 
 var nodeAddress string
 var miningAddress string
 
 var knownNodes = []string{"localhost:3000"}
-var mempool = make(map[string]Transaction)
+var mempool = make(Mempool)
 var blocksInTransit = [][]byte{}
 
+// blockMaxSize is the most transaction bytes the miner puts in a block.
+const blockMaxSize = 100000
+
 func StartServer(nodeID, minerAddress string) {
-	nodeAddress := fmt.Sprintf("localhost: %s", nodeID)
+	nodeAddress = fmt.Sprintf("localhost:%s", nodeID)
 
 	miningAddress = minerAddress
 
@@ -30,6 +36,15 @@ func StartServer(nodeID, minerAddress string) {
 		panic(err)
 	}
 	bc := NewBlockChain(nodeID)
+	mempool = LoadMempool(bc)
+
+	go func() {
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+		<-sig
+		bc.Close()
+		os.Exit(0)
+	}()
 
 	if nodeAddress != knownNodes[0] {
 		sendVersion(knownNodes[0], bc)
@@ -68,6 +83,8 @@ func handleConnection(conn net.Conn, bc *Blockchain) {
 		handleGetData(request, bc)
 	case "tx":
 		handleTx(request, bc)
+	case "reject":
+		handleReject(request)
 	default:
 		fmt.Println("Unkown Command!")
 	}
@@ -159,6 +176,9 @@ func handleInv(request []byte, bc *Blockchain) {
 	fmt.Printf("Recevied inventory with %d %s \n", len(payload.Items), payload.Type)
 
 	if payload.Type == "block" {
+		// Inventories list the newest block first; fetch parents first so
+		// every block arrives extending the tip.
+		ReverseHashes(payload.Items)
 		blocksInTransit = payload.Items
 		blockHash := payload.Items[0]
 		sendGetData(payload.AddrFrom, "block", blockHash)
@@ -325,6 +345,14 @@ type tx struct {
 	Transaction []byte
 }
 
+type reject struct {
+	AddrFrom string
+	Message  string
+	Code     byte
+	Reason   string
+	ID       []byte
+}
+
 type addr struct {
 	AddrList []string
 }
@@ -364,6 +392,27 @@ func sendTx(addr string, tnx *Transaction) {
 	sendData(addr, request)
 }
 
+func sendReject(addr, message string, rejectErr RejectError, id []byte) {
+	payload := gobEncode(reject{nodeAddress, message, rejectErr.Code, rejectErr.Reason, id})
+	request := append(commandToBytes("reject"), payload...)
+
+	sendData(addr, request)
+}
+
+func handleReject(request []byte) {
+	var buff bytes.Buffer
+	var payload reject
+
+	buff.Write(request[commandLength:])
+	dec := gob.NewDecoder(&buff)
+	err := dec.Decode(&payload)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	fmt.Printf("%s rejected %s %x (code %#x): %s\n", payload.AddrFrom, payload.Message, payload.ID, payload.Code, payload.Reason)
+}
+
 func handleBlock(request []byte, bc *Blockchain) {
 
 	var buff bytes.Buffer
@@ -384,20 +433,25 @@ func handleBlock(request []byte, bc *Blockchain) {
 	fmt.Println("Recevied a new block!")
 
 	bc.AddBlock(block)
+	mempool.RemoveBlock(bc, block)
+	mempool.Save(bc)
 
 	fmt.Printf("Added block %x\n", block.Hash)
+	printSigCacheStats()
 
 	if len(blocksInTransit) > 0 {
 		blockHash := blocksInTransit[0]
 		sendGetData(payload.AddrFrom, "block", blockHash)
 		blocksInTransit = blocksInTransit[1:]
-	} else {
-		UTXOSet := UTXOSet{bc}
-		UTXOSet.ReIndex()
 	}
 
 }
 
+func printSigCacheStats() {
+	hits, misses := sigCache.Stats()
+	fmt.Printf("Signature cache: %d hits, %d misses\n", hits, misses)
+}
+
 func handleTx(request []byte, bc *Blockchain) {
 	var buff bytes.Buffer
 	var payload tx
@@ -415,7 +469,15 @@ func handleTx(request []byte, bc *Blockchain) {
 
 	tx := DeserializeTransaction(txData)
 
-	mempool[hex.EncodeToString(tx.ID)] = tx
+	err = mempool.Accept(bc, &tx)
+	if err != nil {
+		fmt.Printf("Rejected %s\n", err)
+		if rejectErr, ok := err.(RejectError); ok {
+			sendReject(payload.AddrFrom, "tx", rejectErr, tx.ID)
+		}
+		return
+	}
+	mempool.Save(bc)
 
 	if nodeAddress == knownNodes[0] {
 		for _, node := range knownNodes {
@@ -426,34 +488,22 @@ func handleTx(request []byte, bc *Blockchain) {
 	} else {
 		if len(mempool) >= 2 && len(miningAddress) > 0 {
 		MineTransactions:
-			var txs []*Transaction
-			for id := range mempool {
-				tx := mempool[id]
-				if bc.VerifyTransaction(&tx) {
-					txs = append(txs, &tx)
-				}
-			}
+			txs, fees := mempool.BlockTemplate(bc)
 
 			if len(txs) == 0 {
 				fmt.Println("All transactions are invalid! Waiting for new...")
 				return
 			}
 
-			cbTx := NewCoinbaseTx(miningAddress, "")
-			txs = append(txs, cbTx)
-
-			newBlock := bc.MineBlock(txs)
+			cbTx := NewCoinbaseTx(miningAddress, "", fees)
 
-			UTXOSet := UTXOSet{bc}
-			UTXOSet.ReIndex()
+			newBlock := bc.MineBlock(append([]*Transaction{cbTx}, txs...))
 
 			fmt.Println("New block is mined!")
+			printSigCacheStats()
 
-			for _, tx := range txs {
-				txID := hex.EncodeToString(tx.ID)
-				delete(mempool, txID)
-
-			}
+			mempool.RemoveBlock(bc, newBlock)
+			mempool.Save(bc)
 			for _, node := range knownNodes {
 				if node != nodeAddress {
 					sendInv(node, "block", [][]byte{newBlock.Hash})
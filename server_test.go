@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bytes"
+	"encoding/gob"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// startTestNode starts a node in the current directory on a free port, as
+// the central node with peers after it in knownNodes, and returns its
+// address.
+func startTestNode(t *testing.T, peers ...string) string {
+	free, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := strconv.Itoa(free.Addr().(*net.TCPAddr).Port)
+	free.Close()
+	node := "localhost:" + port
+
+	saved := knownNodes
+	knownNodes = append([]string{node}, peers...)
+	t.Cleanup(func() { knownNodes = saved })
+	go StartServer(port, "")
+
+	// An empty addr message changes nothing, so it is sent until one
+	// gets through.
+	request := append(commandToBytes("addr"), gobEncode(addr{})...)
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		conn, err := net.Dial("tcp", node)
+		if err == nil {
+			conn.Write(request)
+			conn.Close()
+			return node
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("node did not start: %v", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// newTestPeer listens for messages from a node, as a peer would.
+func newTestPeer(t *testing.T) *net.TCPListener {
+	peer, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { peer.Close() })
+	return peer.(*net.TCPListener)
+}
+
+// sendTestMessage sends command with payload to addr.
+func sendTestMessage(t *testing.T, addr, command string, payload interface{}) {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_, err = conn.Write(append(commandToBytes(command), gobEncode(payload)...))
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// receiveTestMessage waits for a message to peer, checks it is command
+// and decodes its payload.
+func receiveTestMessage(t *testing.T, peer *net.TCPListener, command string, payload interface{}) {
+	peer.SetDeadline(time.Now().Add(5 * time.Second))
+	conn, err := peer.Accept()
+	if err != nil {
+		t.Fatalf("no %s message: %v", command, err)
+	}
+	request, err := ioutil.ReadAll(conn)
+	conn.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := bytesToCommand(request[:commandLength]); got != command {
+		t.Fatalf("got %s message, want %s", got, command)
+	}
+	err = gob.NewDecoder(bytes.NewReader(request[commandLength:])).Decode(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// newTestSpend returns a transaction spending the genesis coinbase of a
+// new blockchain in the current directory, paying fee, and closes the
+// chain so that a node can open it.
+func newTestSpend(t *testing.T, fee int) *Transaction {
+	from := newTestWallet(t)
+	bc := NewBlockChain(from)
+	defer bc.Close()
+
+	_, sign := walletSigner(from, bc)
+	spend := NewUTXOTransaction(from, from, 5, 0, 0, maxTxFee, false, BranchAndBound{}, bc)
+	spend = &Transaction{nil, spend.Vin, []TXOutput{*NewTXOutput(subsidy-fee, from)}, spend.LockTime}
+	spend.SetId()
+	sign(spend)
+	return spend
+}
+
+// TestHandleTxRejectsToSender sends a node a transaction paying no fee
+// and checks that the reject message comes back to the sender, from the
+// node's own address.
+func TestHandleTxRejectsToSender(t *testing.T) {
+	useTestDir(t)
+	noFee := newTestSpend(t, 0)
+	node := startTestNode(t)
+	sender := newTestPeer(t)
+
+	sendTestMessage(t, node, "tx", tx{sender.Addr().String(), noFee.Serialize()})
+
+	var payload reject
+	receiveTestMessage(t, sender, "reject", &payload)
+	if payload.AddrFrom != node {
+		t.Errorf("reject from %q, want %q", payload.AddrFrom, node)
+	}
+	if payload.Code != RejectInsufficientFee || !bytes.Equal(payload.ID, noFee.ID) {
+		t.Errorf("reject code %#x for %x, want %#x for %x", payload.Code, payload.ID, RejectInsufficientFee, noFee.ID)
+	}
+}
+
+// TestHandleTxRelaysToPeers sends the central node a transaction the way
+// sendrawtransaction does and checks that it announces it to a peer and
+// sends it when the peer asks for it.
+func TestHandleTxRelaysToPeers(t *testing.T) {
+	useTestDir(t)
+	spend := newTestSpend(t, 1)
+	peer := newTestPeer(t)
+	node := startTestNode(t, peer.Addr().String())
+
+	sendTx(node, spend)
+
+	var announced inv
+	receiveTestMessage(t, peer, "inv", &announced)
+	if announced.AddrFrom != node || announced.Type != "tx" || len(announced.Items) != 1 || !bytes.Equal(announced.Items[0], spend.ID) {
+		t.Fatalf("got inventory %+v, want transaction %x from %s", announced, spend.ID, node)
+	}
+
+	sendTestMessage(t, node, "getdata", getData{peer.Addr().String(), "tx", spend.ID})
+
+	var relayed tx
+	receiveTestMessage(t, peer, "tx", &relayed)
+	if got := DeserializeTransaction(relayed.Transaction); !bytes.Equal(got.ID, spend.ID) {
+		t.Errorf("got transaction %x, want %x", got.ID, spend.ID)
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"sync"
+	"sync/atomic"
+)
+
+const sigCacheSize = 50000
+
+// SigCache remembers signature checks that have already passed, so a
+// transaction verified on entering the mempool is not verified again
+// when it is included in a block. Once full, the oldest entry is evicted.
+type SigCache struct {
+	mu      sync.RWMutex
+	entries map[[32]byte]bool
+	ring    [][32]byte
+	next    int
+
+	hits   uint64
+	misses uint64
+}
+
+var sigCache = NewSigCache(sigCacheSize)
+
+func NewSigCache(size int) *SigCache {
+	return &SigCache{
+		entries: make(map[[32]byte]bool, size),
+		ring:    make([][32]byte, size),
+	}
+}
+
+// sigCacheKey hashes every field of check. The legacy flag and the field
+// lengths come first, so no two checks can be laid out as the same bytes.
+func sigCacheKey(check sigCheck) [32]byte {
+	data := make([]byte, 13)
+	if check.legacy {
+		data[0] = 0x01
+	}
+	binary.BigEndian.PutUint32(data[1:], uint32(len(check.hash)))
+	binary.BigEndian.PutUint32(data[5:], uint32(len(check.pubKey)))
+	binary.BigEndian.PutUint32(data[9:], uint32(len(check.signature)))
+	data = append(data, check.hash...)
+	data = append(data, check.pubKey...)
+	data = append(data, check.signature...)
+	return sha256.Sum256(data)
+}
+
+func (c *SigCache) Contains(check sigCheck) bool {
+	c.mu.RLock()
+	found := c.entries[sigCacheKey(check)]
+	c.mu.RUnlock()
+
+	if found {
+		atomic.AddUint64(&c.hits, 1)
+	} else {
+		atomic.AddUint64(&c.misses, 1)
+	}
+	return found
+}
+
+func (c *SigCache) Add(check sigCheck) {
+	key := sigCacheKey(check)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.entries[key] {
+		return
+	}
+	delete(c.entries, c.ring[c.next])
+	c.ring[c.next] = key
+	c.entries[key] = true
+	c.next = (c.next + 1) % len(c.ring)
+}
+
+// Stats returns the number of lookups that hit and missed the cache.
+func (c *SigCache) Stats() (uint64, uint64) {
+	return atomic.LoadUint64(&c.hits), atomic.LoadUint64(&c.misses)
+}
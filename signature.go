@@ -1,36 +1,246 @@
 package main
 
 import (
+	"bytes"
 	"crypto/ecdsa"
 	"crypto/elliptic"
-	"crypto/rand"
+	"crypto/hmac"
+	"crypto/sha256"
 	"encoding/hex"
+	"log"
 	"math/big"
+	"runtime"
+	"sync"
 )
 
-func (tx *Transaction) Sign(privKey ecdsa.PrivateKey, prevTXs map[string]Transaction) {
+// Signature hash types, appended to every signature, select the parts of
+// the transaction it commits to. SigHashAll covers every input and output,
+// SigHashNone no outputs, and SigHashSingle only the output at the signed
+// input's index. SigHashAnyOneCanPay can be combined with any of them to
+// cover only the signed input, letting others add inputs afterwards.
+const (
+	SigHashAll          = 0x01
+	SigHashNone         = 0x02
+	SigHashSingle       = 0x03
+	SigHashAnyOneCanPay = 0x80
+)
+
+var sigHashTypes = map[string]byte{
+	"ALL":                 SigHashAll,
+	"NONE":                SigHashNone,
+	"SINGLE":              SigHashSingle,
+	"ALL|ANYONECANPAY":    SigHashAll | SigHashAnyOneCanPay,
+	"NONE|ANYONECANPAY":   SigHashNone | SigHashAnyOneCanPay,
+	"SINGLE|ANYONECANPAY": SigHashSingle | SigHashAnyOneCanPay,
+}
+
+func (tx *Transaction) Sign(wallet *Wallet, prevOuts map[string]TXOutput) {
 	if tx.IsCoinbase() {
 		return
 	}
 
+	for inID, vin := range tx.Vin {
+		prevOut := prevOuts[hex.EncodeToString(outpointKey(vin.Txid, vin.Vout))]
+		signature := tx.SignInput(wallet.PrivateKey, inID, prevOut.LockingScript(), SigHashAll)
+
+		tx.Vin[inID].ScriptSig = NewScriptBuilder().AddData(signature).AddData(wallet.PublicKey).Script()
+	}
+}
+
+// SignScriptHash signs every input of tx, which must spend outputs paying
+// to the hash of redeemScript, with a key that redeemScript checks with a
+// single OP_CHECKSIG.
+func (tx *Transaction) SignScriptHash(wallet *Wallet, redeemScript []byte) {
+	for inID := range tx.Vin {
+		signature := tx.SignInput(wallet.PrivateKey, inID, redeemScript, SigHashAll)
+
+		tx.Vin[inID].ScriptSig = NewScriptBuilder().AddData(signature).AddData(wallet.PublicKey).
+			AddData(redeemScript).Script()
+	}
+}
+
+// SignInput signs input inID, which spends an output locked by subscript,
+// and returns the signature with hashType appended.
+func (tx *Transaction) SignInput(privKey ecdsa.PrivateKey, inID int, subscript []byte, hashType byte) []byte {
+	hash := tx.SignatureHash(inID, subscript, hashType)
+	if hash == nil {
+		log.Panicf("ERROR: Cannot sign input %d with hash type %#x", inID, hashType)
+	}
+	return append(signHash(privKey, hash), hashType)
+}
+
+// signHash signs hash with a nonce derived from the key and hash as RFC
+// 6979 describes, so signing is deterministic, and returns r and the low
+// form of s, each padded to the size of the curve order.
+func signHash(privKey ecdsa.PrivateKey, hash []byte) []byte {
+	curve := privKey.Curve
+	n := curve.Params().N
+	e := hashToInt(hash, n)
+
+	nextNonce := rfc6979Nonces(privKey.D, hash, n)
+	for {
+		k := nextNonce()
+		x, _ := curve.ScalarBaseMult(k.FillBytes(make([]byte, (n.BitLen()+7)/8)))
+		r := new(big.Int).Mod(x, n)
+		if r.Sign() == 0 {
+			continue
+		}
+
+		// s = (e + r·d) / k, worked out without branching on the key or
+		// nonce.
+		f := scalarFields[curve.Params()]
+		sum := f.add(f.fromBig(e), f.mul(f.fromBig(r), f.fromBig(privKey.D)))
+		s := f.toBig(f.mul(sum, f.inverse(f.fromBig(k))))
+		if s.Sign() == 0 {
+			continue
+		}
+		if s.Cmp(new(big.Int).Rsh(n, 1)) > 0 {
+			s.Sub(n, s)
+		}
+
+		size := (n.BitLen() + 7) / 8
+		signature := make([]byte, 2*size)
+		r.FillBytes(signature[:size])
+		s.FillBytes(signature[size:])
+		return signature
+	}
+}
+
+// scalarFields do arithmetic modulo the order of each curve keys can be
+// on.
+var scalarFields = func() map[*elliptic.CurveParams]*montField {
+	fields := make(map[*elliptic.CurveParams]*montField)
+	for _, curve := range curves {
+		fields[curve.Params()] = newMontField(curve.Params().N)
+	}
+	return fields
+}()
+
+// hashToInt converts hash to an integer no longer than the order n.
+func hashToInt(hash []byte, n *big.Int) *big.Int {
+	e := new(big.Int).SetBytes(hash)
+	if excess := len(hash)*8 - n.BitLen(); excess > 0 {
+		e.Rsh(e, uint(excess))
+	}
+	return e
+}
+
+// rfc6979Nonces returns a function returning in turn the candidate nonces
+// RFC 6979 derives with HMAC-SHA256 from the private key d and hash for a
+// curve of order n.
+func rfc6979Nonces(d *big.Int, hash []byte, n *big.Int) func() *big.Int {
+	size := (n.BitLen() + 7) / 8
+	x := d.FillBytes(make([]byte, size))
+	h := new(big.Int).Mod(hashToInt(hash, n), n).FillBytes(make([]byte, size))
+
+	mac := func(key []byte, data ...[]byte) []byte {
+		m := hmac.New(sha256.New, key)
+		for _, d := range data {
+			m.Write(d)
+		}
+		return m.Sum(nil)
+	}
+
+	v := bytes.Repeat([]byte{0x01}, sha256.Size)
+	k := make([]byte, sha256.Size)
+	k = mac(k, v, []byte{0x00}, x, h)
+	v = mac(k, v)
+	k = mac(k, v, []byte{0x01}, x, h)
+	v = mac(k, v)
+
+	first := true
+	return func() *big.Int {
+		for {
+			if !first {
+				k = mac(k, v, []byte{0x00})
+				v = mac(k, v)
+			}
+			first = false
+
+			var t []byte
+			for len(t) < size {
+				v = mac(k, v)
+				t = append(t, v...)
+			}
+			nonce := hashToInt(t[:size], n)
+			if nonce.Sign() > 0 && nonce.Cmp(n) < 0 {
+				return nonce
+			}
+		}
+	}
+}
+
+// SignatureHash returns the hash signed by input inID, which spends an
+// output locked by subscript, for hashType. Every other input's script is
+// left empty. It returns nil if hashType is invalid for the input.
+func (tx *Transaction) SignatureHash(inID int, subscript []byte, hashType byte) []byte {
+	baseType := hashType &^ SigHashAnyOneCanPay
+	if baseType < SigHashAll || baseType > SigHashSingle {
+		return nil
+	}
+	if baseType == SigHashSingle && inID >= len(tx.Vout) {
+		return nil
+	}
+
 	txCopy := tx.TrimmedCopy()
+	txCopy.ID = nil
+	txCopy.Vin[inID].ScriptSig = subscript
 
-	for inID, vin := range txCopy.Vin {
-		prevTx := prevTXs[hex.EncodeToString(vin.Txid)]
-		txCopy.Vin[inID].Signature = nil
-		txCopy.Vin[inID].PubKey = prevTx.Vout[vin.Vout].PubKeyHash
-		txCopy.ID = txCopy.Hash()
-		txCopy.Vin[inID].PubKey = nil
+	if baseType != SigHashAll {
+		// Other inputs may be replaced without invalidating this one.
+		for i := range txCopy.Vin {
+			if i != inID {
+				txCopy.Vin[i].Sequence = 0
+			}
+		}
+	}
+	switch baseType {
+	case SigHashNone:
+		txCopy.Vout = nil
+	case SigHashSingle:
+		txCopy.Vout = txCopy.Vout[:inID+1]
+		for i := 0; i < inID; i++ {
+			txCopy.Vout[i] = TXOutput{-1, nil, nil}
+		}
+	}
+	if hashType&SigHashAnyOneCanPay != 0 {
+		txCopy.Vin = txCopy.Vin[inID : inID+1]
+	}
 
-		r, s, err := ecdsa.Sign(rand.Reader, &privKey, txCopy.ID)
-		if err != nil {
-			panic(err)
+	hash := sha256.Sum256(append(txCopy.Serialize(), hashType))
+	return hash[:]
+}
+
+// legacySigHashes returns the hashes signed by inputs that carry a bare
+// Signature and PubKey instead of a ScriptSig. Each hash commits to the
+// one before it, so they are computed in order. They are hashes of the
+// transaction gob encoded as it was before scripts existed, and cover only
+// the fields it had then, so it returns nil if tx sets any other.
+func (tx *Transaction) legacySigHashes(prevOuts map[string]TXOutput) [][]byte {
+	if tx.LockTime != 0 {
+		return nil
+	}
+	for _, vin := range tx.Vin {
+		if vin.Sequence != 0 {
+			return nil
 		}
-		signature := append(r.Bytes(), s.Bytes()...)
+	}
+	for _, vout := range tx.Vout {
+		if vout.ScriptPubKey != nil {
+			return nil
+		}
+	}
 
-		tx.Vin[inID].Signature = signature
+	var hashes [][]byte
+	id := tx.ID
+	for inID, vin := range tx.Vin {
+		prevOut := prevOuts[hex.EncodeToString(outpointKey(vin.Txid, vin.Vout))]
+		hash := sha256.Sum256(encodeLegacyTransaction(tx, id, inID, prevOut.AddressHash()))
+		id = hash[:]
 
+		hashes = append(hashes, id)
 	}
+	return hashes
 }
 
 func (tx *Transaction) TrimmedCopy() Transaction {
@@ -38,51 +248,219 @@ func (tx *Transaction) TrimmedCopy() Transaction {
 	var outputs []TXOutput
 
 	for _, vin := range tx.Vin {
-		inputs = append(inputs, TXInput{vin.Txid, vin.Vout, nil, nil})
+		inputs = append(inputs, TXInput{vin.Txid, vin.Vout, nil, nil, nil, vin.Sequence})
 	}
 
 	for _, vout := range tx.Vout {
-		outputs = append(outputs, TXOutput{vout.Value, vout.PubKeyHash})
+		outputs = append(outputs, TXOutput{vout.Value, vout.PubKeyHash, vout.ScriptPubKey})
 	}
 
-	txCopy := Transaction{tx.ID, inputs, outputs}
+	txCopy := Transaction{tx.ID, inputs, outputs, tx.LockTime}
 
 	return txCopy
 
 }
 
-func (tx *Transaction) Verify(prevTXs map[string]Transaction) bool {
-	txCopy := tx.TrimmedCopy()
+// sigCheck is one ECDSA verification needed to validate an input.
+type sigCheck struct {
+	hash      []byte
+	signature []byte
+	pubKey    []byte
+	// legacy checks are of signatures made before scripts existed.
+	legacy bool
+}
+
+// verify checks the signature strictly: it must be r and s padded to the
+// size of the curve order, both in range and s in its low form, so that
+// no one can alter a valid signature into another.
+func (c sigCheck) verify() bool {
+	if c.legacy {
+		return c.verifyLegacy()
+	}
+
+	pubKey, err := parsePubKey(c.pubKey)
+	if err != nil {
+		return false
+	}
+
+	n := pubKey.Curve.Params().N
+	size := (n.BitLen() + 7) / 8
+	if len(c.signature) != 2*size {
+		return false
+	}
+	r := new(big.Int).SetBytes(c.signature[:size])
+	s := new(big.Int).SetBytes(c.signature[size:])
+	if r.Sign() == 0 || r.Cmp(n) >= 0 || s.Sign() == 0 || s.Cmp(new(big.Int).Rsh(n, 1)) > 0 {
+		return false
+	}
+
+	return ecdsa.Verify(pubKey, c.hash, r, s)
+}
 
-	curve := elliptic.P256()
+// verifyLegacy checks a signature the way it was before scripts existed:
+// r and s are the halves of the signature and the P-256 key's X and Y the
+// halves of the public key, each of any length.
+func (c sigCheck) verifyLegacy() bool {
+	sigLen, keyLen := len(c.signature), len(c.pubKey)
+	r := new(big.Int).SetBytes(c.signature[:sigLen/2])
+	s := new(big.Int).SetBytes(c.signature[sigLen/2:])
+	x := new(big.Int).SetBytes(c.pubKey[:keyLen/2])
+	y := new(big.Int).SetBytes(c.pubKey[keyLen/2:])
+
+	if !elliptic.P256().IsOnCurve(x, y) {
+		return false
+	}
+	return ecdsa.Verify(&ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y}, c.hash, r, s)
+}
+
+// verifyCached skips checks found in sigCache and adds passing ones to it.
+func (c sigCheck) verifyCached() bool {
+	if sigCache.Contains(c) {
+		return true
+	}
+	if !c.verify() {
+		return false
+	}
+	sigCache.Add(c)
+	return true
+}
+
+// txSigChecker checks signatures made over input inID of tx.
+type txSigChecker struct {
+	tx   *Transaction
+	inID int
+	// legacyHash is set for inputs signed before scripts existed.
+	legacyHash []byte
+}
+
+// CheckSig verifies signature, which ends in its hash type unless the
+// input predates scripts.
+func (c txSigChecker) CheckSig(signature, pubKey, subscript []byte) bool {
+	if c.legacyHash != nil {
+		return sigCheck{c.legacyHash, signature, pubKey, true}.verifyCached()
+	}
+
+	if len(signature) < 2 {
+		return false
+	}
+	hashType := signature[len(signature)-1]
+	signature = signature[:len(signature)-1]
+	hash := c.tx.SignatureHash(c.inID, subscript, hashType)
+	if hash == nil {
+		return false
+	}
+	return sigCheck{hash, signature, pubKey, false}.verifyCached()
+}
+
+// CheckLockTime requires the locktime of tx to be of the same kind as
+// lockTime and at least as late, and to be enforced for this input.
+func (c txSigChecker) CheckLockTime(lockTime int64) bool {
+	txLockTime := int64(c.tx.LockTime)
+	if (lockTime < LockTimeThreshold) != (txLockTime < LockTimeThreshold) {
+		return false
+	}
+	if lockTime > txLockTime {
+		return false
+	}
+	return c.tx.Vin[c.inID].Sequence != SequenceFinal
+}
+
+// CheckSequence requires the relative lock in this input's sequence to be
+// enabled, of the same kind as sequence and at least as long.
+func (c txSigChecker) CheckSequence(sequence int64) bool {
+	txSequence := int64(c.tx.Vin[c.inID].Sequence)
+	if txSequence&SequenceLockTimeDisableFlag != 0 {
+		return false
+	}
+
+	mask := int64(SequenceLockTimeTypeFlag | SequenceLockTimeMask)
+	sequence &= mask
+	txSequence &= mask
+	if (sequence < SequenceLockTimeTypeFlag) != (txSequence < SequenceLockTimeTypeFlag) {
+		return false
+	}
+	return sequence <= txSequence
+}
+
+// scriptCheck runs the unlocking script of one input against the locking
+// script of the output it spends.
+type scriptCheck struct {
+	unlocking []byte
+	locking   []byte
+	checker   SigChecker
+}
+
+func (c scriptCheck) verify() bool {
+	return VerifyScript(c.unlocking, c.locking, c.checker) == nil
+}
+
+// scriptChecks returns the script checks for every input of tx.
+func (tx *Transaction) scriptChecks(prevOuts map[string]TXOutput) []scriptCheck {
+	var checks []scriptCheck
+	var legacy [][]byte
 
 	for inID, vin := range tx.Vin {
-		prevTx := prevTXs[hex.EncodeToString(vin.Txid)]
-		txCopy.Vin[inID].Signature = nil
-		txCopy.Vin[inID].PubKey = prevTx.Vout[vin.Vout].PubKeyHash
-		txCopy.ID = txCopy.Hash()
-		txCopy.Vin[inID].PubKey = nil
+		prevOut := prevOuts[hex.EncodeToString(outpointKey(vin.Txid, vin.Vout))]
 
-		r := big.Int{}
-		s := big.Int{}
+		checker := txSigChecker{tx: tx, inID: inID}
+		if vin.ScriptSig == nil {
+			if legacy == nil {
+				legacy = tx.legacySigHashes(prevOuts)
+			}
+			if legacy != nil {
+				checker.legacyHash = legacy[inID]
+			}
+		}
 
-		sigLen := len(vin.Signature)
-		r.SetBytes(vin.Signature[:(sigLen / 2)])
-		s.SetBytes(vin.Signature[(sigLen / 2):])
+		checks = append(checks, scriptCheck{vin.UnlockingScript(), prevOut.LockingScript(), checker})
+	}
+	return checks
+}
 
-		x := big.Int{}
-		y := big.Int{}
+// verifyScriptChecks runs checks on a pool of GOMAXPROCS workers, stopping
+// as soon as one of them fails.
+func verifyScriptChecks(checks []scriptCheck) bool {
+	workers := runtime.GOMAXPROCS(0)
+	if workers > len(checks) {
+		workers = len(checks)
+	}
 
-		keyLen := len(vin.PubKey)
+	jobs := make(chan scriptCheck)
+	failed := make(chan struct{})
+	var once sync.Once
+	var wg sync.WaitGroup
 
-		x.SetBytes(vin.PubKey[:(keyLen / 2)])
-		y.SetBytes(vin.PubKey[(keyLen / 2):])
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for check := range jobs {
+				if !check.verify() {
+					once.Do(func() { close(failed) })
+				}
+			}
+		}()
+	}
 
-		rawPubKey := ecdsa.PublicKey{curve, &x, &y}
-		if !ecdsa.Verify(&rawPubKey, txCopy.ID, &r, &s) {
-			return false
+Feed:
+	for _, check := range checks {
+		select {
+		case jobs <- check:
+		case <-failed:
+			break Feed
 		}
+	}
+	close(jobs)
+	wg.Wait()
 
+	select {
+	case <-failed:
+		return false
+	default:
+		return true
 	}
-	return true
+}
+
+func (tx *Transaction) Verify(prevOuts map[string]TXOutput) bool {
+	return verifyScriptChecks(tx.scriptChecks(prevOuts))
 }
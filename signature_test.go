@@ -0,0 +1,256 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/sha256"
+	"encoding/hex"
+	"math/big"
+	"reflect"
+	"testing"
+)
+
+func hexInt(t *testing.T, s string) *big.Int {
+	x, ok := new(big.Int).SetString(s, 16)
+	if !ok {
+		t.Fatalf("invalid hex integer %q", s)
+	}
+	return x
+}
+
+func testKey(t *testing.T, curve elliptic.Curve, d string) ecdsa.PrivateKey {
+	var key ecdsa.PrivateKey
+	key.Curve = curve
+	key.D = hexInt(t, d)
+	key.X, key.Y = curve.ScalarBaseMult(key.D.FillBytes(make([]byte, 32)))
+	return key
+}
+
+// TestSignHashRFC6979 checks the P-256 SHA-256 vector for the message
+// "sample" in RFC 6979, A.2.5, whose s is high and so signed as n - s.
+func TestSignHashRFC6979(t *testing.T) {
+	key := testKey(t, elliptic.P256(), "C9AFA9D845BA75166B5C215767B1D6934E50C3DB36E89B127B8A622B120F6721")
+	if want := hexInt(t, "60FED4BA255A9D31C961EB74C6356D68C049B8923B61FA6CE669622E60F29FB6"); key.X.Cmp(want) != 0 {
+		t.Fatalf("public key X = %x, want %x", key.X, want)
+	}
+
+	hash := sha256.Sum256([]byte("sample"))
+	signature := signHash(key, hash[:])
+
+	n := elliptic.P256().Params().N
+	r := hexInt(t, "EFD48B2AACB6A8FD1140DD9CD45E81D69D2C877B56AAF991C34D0EA84EAF3716")
+	s := hexInt(t, "F7CB1C942D657C41D436C7A1B6E29F65F3E900DBB9AFF4064DC4AB2F843ACDA8")
+	s.Sub(n, s)
+	want := append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+	if hex.EncodeToString(signature) != hex.EncodeToString(want) {
+		t.Errorf("signature = %x, want %x", signature, want)
+	}
+}
+
+func TestSigCheckStrict(t *testing.T) {
+	for _, curve := range []elliptic.Curve{elliptic.P256(), secp256k1} {
+		key := testKey(t, curve, "C9AFA9D845BA75166B5C215767B1D6934E50C3DB36E89B127B8A622B120F6721")
+		pubKey := encodePubKey(&key.PublicKey)
+		hash := sha256.Sum256([]byte("sample"))
+		signature := signHash(key, hash[:])
+
+		n := curve.Params().N
+		highS := append([]byte{}, signature[:32]...)
+		highS = append(highS, new(big.Int).Sub(n, new(big.Int).SetBytes(signature[32:])).FillBytes(make([]byte, 32))...)
+		otherHash := sha256.Sum256([]byte("test"))
+
+		tests := []struct {
+			name      string
+			hash      []byte
+			signature []byte
+			valid     bool
+		}{
+			{"low s", hash[:], signature, true},
+			{"high s", hash[:], highS, false},
+			{"short", hash[:], signature[1:], false},
+			{"long", hash[:], append([]byte{0}, signature...), false},
+			{"zero r", hash[:], append(make([]byte, 32), signature[32:]...), false},
+			{"other hash", otherHash[:], signature, false},
+		}
+		for _, test := range tests {
+			if valid := (sigCheck{test.hash, test.signature, pubKey, false}).verify(); valid != test.valid {
+				t.Errorf("%s: %s signature valid = %v, want %v", curve.Params().Name, test.name, valid, test.valid)
+			}
+		}
+	}
+}
+
+func hexBytes(t *testing.T, s string) []byte {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// TestLegacySigHashes checks the spend in blockchain.dat that was signed
+// before scripts, whose hash depends on the exact bytes of the old encoding.
+func TestLegacySigHashes(t *testing.T) {
+	prevTxid := hexBytes(t, "ef3169c0bc92c00de1ed3bc05bae28255cd3e8710f19fa0447a432224ced6453")
+	tx := Transaction{
+		hexBytes(t, "843b6997df3281bdba6615f6d79998ce3c69eb31d0285b01279228950f219d91"),
+		[]TXInput{{
+			prevTxid, 0,
+			hexBytes(t, "689bf25698be7011f213629d59f3690c3670f259133c13a3d100eeedde4ce860d05b2c9b8f699b548b99d5eace12cd2f153711af3313132c222c788147160156"),
+			hexBytes(t, "687dbddbd3f42a09c08f335ceaa412bc2a59aff9f667bd9c036d4218396fd4a301ff874e8e705464f3e8607439d1d3c23f274ed8670609f2b2f78e488ef30b45"),
+			nil, 0,
+		}},
+		[]TXOutput{
+			{2, hexBytes(t, "64faa59ee41eeffe46043a805d6c76f29c3d1276"), nil},
+			{8, hexBytes(t, "0da3622afcc92c3b6691c4238d964189ff955b83"), nil},
+		},
+		0,
+	}
+	prevOuts := map[string]TXOutput{
+		hex.EncodeToString(outpointKey(prevTxid, 0)): {10, hexBytes(t, "0da3622afcc92c3b6691c4238d964189ff955b83"), nil},
+	}
+
+	hashes := tx.legacySigHashes(prevOuts)
+	if want := "ad8195e5304fd578f58dcc06642190ed66bea41c5b761888b653a2e3bd44b721"; len(hashes) != 1 || hex.EncodeToString(hashes[0]) != want {
+		t.Fatalf("legacySigHashes = %x, want [%s]", hashes, want)
+	}
+	if !tx.Verify(prevOuts) {
+		t.Error("legacy transaction does not verify")
+	}
+	tx.Vout[0].Value++
+	if tx.Verify(prevOuts) {
+		t.Error("legacy transaction with a changed output verifies")
+	}
+}
+
+// TestTransactionSerialize pins the bytes transactions and so their ids
+// have always had, and checks that they decode back.
+func TestTransactionSerialize(t *testing.T) {
+	tx := Transaction{
+		[]byte{0xaa},
+		[]TXInput{
+			{[]byte{1, 2}, 3, []byte{4}, []byte{5}, []byte{6, 7}, 0xfffffffe},
+			{nil, 0, nil, nil, nil, 0},
+		},
+		[]TXOutput{{5, []byte{8}, []byte{9}}, {-1, nil, nil}, {0, nil, nil}},
+		500000000,
+	}
+	want := hex.EncodeToString(transactionTypes) + "35ff8c0101aa01020102010201060101040101050102060701fcfffffffe00000103010a010108010109000101000001fc1dcd650000"
+
+	serialized := tx.Serialize()
+	if hex.EncodeToString(serialized) != want {
+		t.Fatalf("Serialize = %x, want %s", serialized, want)
+	}
+	if decoded := DeserializeTransaction(serialized); !reflect.DeepEqual(decoded, tx) {
+		t.Errorf("DeserializeTransaction = %+v, want %+v", decoded, tx)
+	}
+}
+
+// TestVerifyScripts spends pay-to-pubkey-hash, pay-to-script-hash and
+// multisig outputs, each with a valid and an invalid unlocking script.
+func TestVerifyScripts(t *testing.T) {
+	wallets := []*Wallet{NewWallet(secp256k1), NewWallet(secp256k1), NewWallet(secp256k1)}
+	redeemScript := PayToPubKeyHashScript(HashPubKey(wallets[0].PublicKey))
+	multisigScript := MultisigScript(2, [][]byte{wallets[0].PublicKey, wallets[1].PublicKey, wallets[2].PublicKey})
+
+	tests := []struct {
+		name    string
+		prevOut TXOutput
+		unlock  func(tx *Transaction) []byte
+		valid   bool
+	}{
+		{
+			"p2pkh",
+			TXOutput{10, nil, PayToPubKeyHashScript(HashPubKey(wallets[0].PublicKey))},
+			func(tx *Transaction) []byte {
+				signature := tx.SignInput(wallets[0].PrivateKey, 0, PayToPubKeyHashScript(HashPubKey(wallets[0].PublicKey)), SigHashAll)
+				return NewScriptBuilder().AddData(signature).AddData(wallets[0].PublicKey).Script()
+			},
+			true,
+		},
+		{
+			"p2pkh other key",
+			TXOutput{10, nil, PayToPubKeyHashScript(HashPubKey(wallets[0].PublicKey))},
+			func(tx *Transaction) []byte {
+				signature := tx.SignInput(wallets[1].PrivateKey, 0, PayToPubKeyHashScript(HashPubKey(wallets[0].PublicKey)), SigHashAll)
+				return NewScriptBuilder().AddData(signature).AddData(wallets[1].PublicKey).Script()
+			},
+			false,
+		},
+		{
+			"p2sh",
+			TXOutput{10, nil, PayToScriptHashScript(HashPubKey(redeemScript))},
+			func(tx *Transaction) []byte {
+				tx.SignScriptHash(wallets[0], redeemScript)
+				return tx.Vin[0].ScriptSig
+			},
+			true,
+		},
+		{
+			"p2sh other script",
+			TXOutput{10, nil, PayToScriptHashScript(HashPubKey(redeemScript))},
+			func(tx *Transaction) []byte {
+				tx.SignScriptHash(wallets[1], PayToPubKeyHashScript(HashPubKey(wallets[1].PublicKey)))
+				return tx.Vin[0].ScriptSig
+			},
+			false,
+		},
+		{
+			"multisig",
+			TXOutput{10, nil, PayToScriptHashScript(HashPubKey(multisigScript))},
+			func(tx *Transaction) []byte {
+				b := NewScriptBuilder()
+				for _, wallet := range []*Wallet{wallets[0], wallets[2]} {
+					b.AddData(tx.SignInput(wallet.PrivateKey, 0, multisigScript, SigHashAll))
+				}
+				return b.AddData(multisigScript).Script()
+			},
+			true,
+		},
+		{
+			"multisig one signature",
+			TXOutput{10, nil, PayToScriptHashScript(HashPubKey(multisigScript))},
+			func(tx *Transaction) []byte {
+				signature := tx.SignInput(wallets[0].PrivateKey, 0, multisigScript, SigHashAll)
+				return NewScriptBuilder().AddData(signature).AddData(signature).AddData(multisigScript).Script()
+			},
+			false,
+		},
+	}
+	for _, test := range tests {
+		prevTxid := sha256.Sum256([]byte(test.name))
+		tx := Transaction{nil, []TXInput{{prevTxid[:], 0, nil, nil, nil, NonReplaceableSequence}}, []TXOutput{{9, nil, PayToPubKeyHashScript(HashPubKey(wallets[1].PublicKey))}}, 0}
+		tx.ID = tx.Hash()
+		prevOuts := map[string]TXOutput{hex.EncodeToString(outpointKey(prevTxid[:], 0)): test.prevOut}
+
+		tx.Vin[0].ScriptSig = test.unlock(&tx)
+		if valid := tx.Verify(prevOuts); valid != test.valid {
+			t.Errorf("%s: Verify = %v, want %v", test.name, valid, test.valid)
+		}
+		if test.valid {
+			tx.Vout[0].Value--
+			if tx.Verify(prevOuts) {
+				t.Errorf("%s: Verify with a changed output = true", test.name)
+			}
+		}
+	}
+}
+
+// TestSigCacheKey checks that checks whose fields join to the same bytes,
+// or differ only in being legacy, are cached apart.
+func TestSigCacheKey(t *testing.T) {
+	checks := []sigCheck{
+		{[]byte{1}, []byte{2, 0, 9}, nil, false},
+		{[]byte{1, 0}, nil, []byte{0, 9}, false},
+		{[]byte{1}, []byte{2, 1}, []byte{3}, false},
+		{[]byte{1}, []byte{2}, []byte{3}, true},
+	}
+	keys := make(map[[32]byte]int)
+	for i, check := range checks {
+		key := sigCacheKey(check)
+		if j, ok := keys[key]; ok {
+			t.Errorf("checks %d and %d have the same cache key", j, i)
+		}
+		keys[key] = i
+	}
+}
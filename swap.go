@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"log"
+)
+
+const swapSecretSize = 32
+
+// Default contract lifetimes. The initiator's contract must outlive the
+// participant's so the participant has time to redeem after the secret is
+// revealed.
+const initiatorLockDuration = 48 * 60 * 60
+const participantLockDuration = 24 * 60 * 60
+
+func NewSwapSecret() ([]byte, []byte) {
+	secret := make([]byte, swapSecretSize)
+	_, err := rand.Read(secret)
+	if err != nil {
+		log.Panic(err)
+	}
+	secretHash := sha256.Sum256(secret)
+	return secret, secretHash[:]
+}
+
+// NewSwapContract returns a contract paying from's coins to to given the
+// preimage of secretHash, or back to from after lockTime, and the
+// transaction funding it with amount.
+func NewSwapContract(from, to string, amount int, secretHash []byte, lockTime int64, bc *Blockchain) ([]byte, *Transaction) {
+	_, recipientHash := decodeAddress([]byte(to))
+	_, refundHash := decodeAddress([]byte(from))
+
+	contract := AtomicSwapScript(recipientHash, refundHash, lockTime, secretHash)
+	tx := NewUTXOTransaction(from, string(ScriptAddress(contract)), amount, 0, 0, maxTxFee, false, BranchAndBound{}, bc)
+
+	return contract, tx
+}
+
+// contractOutput returns the index of the output of tx paying to contract.
+func contractOutput(tx *Transaction, contract []byte) (int, bool) {
+	scriptHash := HashPubKey(contract)
+	for outIdx, out := range tx.Vout {
+		if bytes.Equal(extractScriptHash(out.ScriptPubKey), scriptHash) {
+			return outIdx, true
+		}
+	}
+	return 0, false
+}
+
+// NewSwapRedeemTransaction spends the contract output of contractTx to the
+// recipient, revealing secret, less a fee set as newSwapSpend describes.
+func NewSwapRedeemTransaction(contract []byte, contractTx *Transaction, secret []byte, fee, feeRate, maxFee int, wallets *Wallets) *Transaction {
+	terms, ok := extractAtomicSwapScript(contract)
+	if !ok {
+		log.Panic("ERROR: Not an atomic swap contract")
+	}
+
+	return newSwapSpend(contract, contractTx, terms.RecipientHash, 0, fee, feeRate, maxFee, wallets, func(signature []byte, wallet *Wallet) []byte {
+		return NewScriptBuilder().AddData(signature).AddData(wallet.PublicKey).AddData(secret).
+			AddOp(OP_TRUE).AddData(contract).Script()
+	})
+}
+
+// NewSwapRefundTransaction spends the contract output of contractTx back
+// to the refund address, less a fee set as newSwapSpend describes. It
+// cannot be mined before the contract expires.
+func NewSwapRefundTransaction(contract []byte, contractTx *Transaction, fee, feeRate, maxFee int, wallets *Wallets) *Transaction {
+	terms, ok := extractAtomicSwapScript(contract)
+	if !ok {
+		log.Panic("ERROR: Not an atomic swap contract")
+	}
+
+	return newSwapSpend(contract, contractTx, terms.RefundHash, terms.LockTime, fee, feeRate, maxFee, wallets, func(signature []byte, wallet *Wallet) []byte {
+		return NewScriptBuilder().AddData(signature).AddData(wallet.PublicKey).
+			AddOp(OP_FALSE).AddData(contract).Script()
+	})
+}
+
+// newSwapSpend returns a transaction moving the contract output of
+// contractTx to the address of keyHash, signed with the wallet holding its
+// key and unlocked with the script unlock makes from the signature. The
+// fee, taken from the output, is at least fee and at least feeRate, or
+// minRelayFeeRate if that is higher, per feeRateSize bytes, and at most
+// maxFee.
+func newSwapSpend(contract []byte, contractTx *Transaction, keyHash []byte, lockTime int64, fee, feeRate, maxFee int, wallets *Wallets, unlock func(signature []byte, wallet *Wallet) []byte) *Transaction {
+	address := string(encodeAddress(version, keyHash))
+	wallet, ok := wallets.Wallets[address]
+	if !ok {
+		log.Panicf("ERROR: No key for %s in wallet", address)
+	}
+
+	outIdx, ok := contractOutput(contractTx, contract)
+	if !ok {
+		log.Panicf("ERROR: Transaction %x does not pay to the contract", contractTx.ID)
+	}
+	value := contractTx.Vout[outIdx].Value
+
+	if feeRate < minRelayFeeRate {
+		feeRate = minRelayFeeRate
+	}
+
+	// As in fundTransaction, the fee for the signed size may need another
+	// round.
+	for {
+		if fee > maxFee {
+			log.Panicf("ERROR: Fee of %d is above the maximum of %d", fee, maxFee)
+		}
+		if isDust(value-fee, feeRate) {
+			log.Panicf("ERROR: Contract value %d less a fee of %d is dust", value, fee)
+		}
+
+		input := TXInput{contractTx.ID, outIdx, nil, nil, nil, NonReplaceableSequence}
+		output := NewTXOutput(value-fee, address)
+
+		tx := Transaction{nil, []TXInput{input}, []TXOutput{*output}, uint32(lockTime)}
+		tx.SetId()
+		signature := tx.SignInput(wallet.PrivateKey, 0, contract, SigHashAll)
+		tx.Vin[0].ScriptSig = unlock(signature, wallet)
+
+		required := (feeRate*tx.Size() + feeRateSize - 1) / feeRateSize
+		if fee < required {
+			fee = required
+			continue
+		}
+
+		return &tx
+	}
+}
+
+// extractSwapSecret returns the secret revealed by input inID of tx if it
+// redeems contract.
+func extractSwapSecret(tx *Transaction, inID int, contract []byte) ([]byte, bool) {
+	ops, err := parseScript(tx.Vin[inID].ScriptSig)
+	if err != nil || len(ops) != 5 || !bytes.Equal(ops[4].data, contract) || ops[3].opcode != OP_TRUE {
+		return nil, false
+	}
+	return ops[2].data, true
+}
+
+// FindSpendingTransaction returns the main chain transaction spending
+// output vout of txid and the index of the input spending it.
+func (bc *Blockchain) FindSpendingTransaction(txid []byte, vout int) (*Transaction, int, bool) {
+	bci := bc.Iterator()
+
+	for {
+		block := bci.Next()
+		for _, tx := range block.Transactions {
+			if tx.IsCoinbase() {
+				continue
+			}
+			for inID, vin := range tx.Vin {
+				if bytes.Equal(vin.Txid, txid) && vin.Vout == vout {
+					return tx, inID, true
+				}
+			}
+		}
+		if len(block.PrevBlockHash) == 0 {
+			return nil, 0, false
+		}
+	}
+}
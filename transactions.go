@@ -2,6 +2,7 @@ package main
 
 import (
 	"bytes"
+	"crypto/rand"
 	"crypto/sha256"
 	"encoding/gob"
 	"encoding/hex"
@@ -9,34 +10,75 @@ import (
 	"log"
 )
 
+// TXOutput is locked by ScriptPubKey. Outputs created before scripts
+// existed only carry PubKeyHash and are treated as pay-to-pubkey-hash.
 type TXOutput struct {
-	Value      int
-	PubKeyHash []byte
-}
-
-type TXOutputs struct {
-	Outputs []TXOutput
+	Value        int
+	PubKeyHash   []byte
+	ScriptPubKey []byte
 }
 
+// TXInput is unlocked by ScriptSig. Inputs created before scripts
+// existed carry Signature and PubKey instead. A Sequence of SequenceFinal
+// opts the input out of the transaction's LockTime.
 type TXInput struct {
 	Txid      []byte
 	Vout      int
 	Signature []byte
 	PubKey    []byte
+	ScriptSig []byte
+	Sequence  uint32
 }
 
+// Transaction cannot be mined before LockTime, a block height if below
+// LockTimeThreshold and a unix time otherwise, unless it is zero or every
+// input is final.
 type Transaction struct {
-	ID   []byte
-	Vin  []TXInput
-	Vout []TXOutput
+	ID       []byte
+	Vin      []TXInput
+	Vout     []TXOutput
+	LockTime uint32
 }
 
+const LockTimeThreshold = 500000000
+const SequenceFinal = 0xffffffff
+
+// A transaction with an input whose Sequence is at most
+// MaxReplaceableSequence may be replaced in the mempool by one paying a
+// higher fee. Wallets otherwise use NonReplaceableSequence, which still
+// enforces LockTime.
+const MaxReplaceableSequence = 0xfffffffd
+const NonReplaceableSequence = 0xfffffffe
+
+// An input's Sequence also holds a relative lock on the output it spends:
+// a number of blocks, or of 512 second units if SequenceLockTimeTypeFlag
+// is set, that must pass after the output is mined. Setting
+// SequenceLockTimeDisableFlag turns the lock off.
+const SequenceLockTimeDisableFlag = 1 << 31
+const SequenceLockTimeTypeFlag = 1 << 22
+const SequenceLockTimeMask = 0x0000ffff
+const SequenceLockTimeGranularity = 9
+
 const subsidy = 10
 
-func (outs TXOutputs) Serialize() []byte {
+// maxMoney bounds every output value and every sum of values a
+// transaction or block is checked against, so that none can overflow.
+const maxMoney = 21000000
+
+// maxTxFee is the highest fee a wallet pays for a transaction unless it is
+// given a higher maximum.
+const maxTxFee = subsidy
+
+// Fee rates are charged per feeRateSize bytes of serialized transaction.
+const feeRateSize = 1000
+
+// maxDataCarrierSize is the most data a data output may carry.
+const maxDataCarrierSize = 80
+
+func (out TXOutput) Serialize() []byte {
 	var buff bytes.Buffer
 	enc := gob.NewEncoder(&buff)
-	err := enc.Encode(outs)
+	err := enc.Encode(out)
 	if err != nil {
 		panic(err)
 	}
@@ -44,62 +86,115 @@ func (outs TXOutputs) Serialize() []byte {
 	return buff.Bytes()
 }
 
-func DeserializeOutputs(data []byte) TXOutputs {
-	var outputs TXOutputs
+func DeserializeOutput(data []byte) TXOutput {
+	var output TXOutput
 	dec := gob.NewDecoder(bytes.NewReader(data))
-	err := dec.Decode(&outputs)
+	err := dec.Decode(&output)
 	if err != nil {
 		panic(err)
 	}
-	return outputs
+	return output
 }
 
 func NewTXOutput(value int, address string) *TXOutput {
-	txo := &TXOutput{value, nil}
+	txo := &TXOutput{value, nil, nil}
 	txo.Lock([]byte(address))
 	return txo
 }
 
+// NewDataOutput returns an output carrying data that can never be spent.
+func NewDataOutput(data []byte) *TXOutput {
+	if len(data) > maxDataCarrierSize {
+		log.Panicf("ERROR: Data is %d bytes, the limit is %d", len(data), maxDataCarrierSize)
+	}
+	return &TXOutput{0, nil, NullDataScript(data)}
+}
+
+// IsUnspendable reports whether out can never be spent, and so is kept
+// out of the UTXO set.
+func (out *TXOutput) IsUnspendable() bool {
+	return len(out.ScriptPubKey) > 0 && out.ScriptPubKey[0] == OP_RETURN
+}
+
 func (in *TXInput) UsesKey(pubKeyHash []byte) bool {
 	lockingHash := HashPubKey(in.PubKey)
 	return bytes.Compare(lockingHash, pubKeyHash) == 0
 }
 
+// UnlockingScript returns the script that satisfies the output in spends.
+func (in *TXInput) UnlockingScript() []byte {
+	if in.ScriptSig != nil {
+		return in.ScriptSig
+	}
+	return NewScriptBuilder().AddData(in.Signature).AddData(in.PubKey).Script()
+}
+
 func (out *TXOutput) Lock(address []byte) {
-	pubKeyHash := Base58Decode(address)
-	pubKeyHash = pubKeyHash[1 : len(pubKeyHash)-4]
-	out.PubKeyHash = pubKeyHash
+	addrVersion, hash := decodeAddress(address)
+	if addrVersion == scriptVersion {
+		out.ScriptPubKey = PayToScriptHashScript(hash)
+		return
+	}
+	out.ScriptPubKey = PayToPubKeyHashScript(hash)
+}
+
+// LockingScript returns the script that must be satisfied to spend out.
+func (out *TXOutput) LockingScript() []byte {
+	if out.ScriptPubKey != nil {
+		return out.ScriptPubKey
+	}
+	return PayToPubKeyHashScript(out.PubKeyHash)
+}
+
+// AddressHash returns the key or redeem script hash that out pays to, or
+// nil if out is not locked by a standard script.
+func (out *TXOutput) AddressHash() []byte {
+	if out.ScriptPubKey == nil {
+		return out.PubKeyHash
+	}
+	if pubKeyHash := extractPubKeyHash(out.ScriptPubKey); pubKeyHash != nil {
+		return pubKeyHash
+	}
+	return extractScriptHash(out.ScriptPubKey)
 }
 
 func (out *TXOutput) isLockedWithKey(pubKeyHash []byte) bool {
-	return bytes.Compare(out.PubKeyHash, pubKeyHash) == 0
+	return bytes.Compare(out.AddressHash(), pubKeyHash) == 0
 }
 
-func NewCoinbaseTx(to, data string) *Transaction {
+// NewCoinbaseTx returns a transaction paying the block subsidy and the
+// fees of the block's other transactions to to.
+func NewCoinbaseTx(to, data string, fees int) *Transaction {
 	if data == "" {
-		data = fmt.Sprintf("Reward to '%s'", to)
+		data = fmt.Sprintf("Reward to '%s' %x", to, coinbaseNonce())
 	}
 
-	txin := TXInput{[]byte{}, -1, nil, []byte(data)}
+	txin := TXInput{[]byte{}, -1, nil, []byte(data), nil, 0}
 
-	txout := NewTXOutput(subsidy, to)
+	txout := NewTXOutput(subsidy+fees, to)
 
-	tx := Transaction{nil, []TXInput{txin}, []TXOutput{*txout}}
+	tx := Transaction{nil, []TXInput{txin}, []TXOutput{*txout}, 0}
 
 	tx.SetId()
 
 	return &tx
 }
 
-func (tx *Transaction) Serialize() []byte {
-	var encoder bytes.Buffer
-
-	enc := gob.NewEncoder(&encoder)
-	err := enc.Encode(tx)
+// coinbaseNonce returns random bytes for the default coinbase data. A
+// coinbase spends nothing, so two paying the same amount to the same
+// address would otherwise share a txid, and the later one would overwrite
+// the earlier one's unspent outputs.
+func coinbaseNonce() []byte {
+	nonce := make([]byte, 8)
+	_, err := rand.Read(nonce)
 	if err != nil {
-		panic(err)
+		log.Panic(err)
 	}
-	return encoder.Bytes()
+	return nonce
+}
+
+func (tx *Transaction) Serialize() []byte {
+	return encodeTransaction(tx)
 }
 func DeserializeTransaction(data []byte) Transaction {
 	var transaction Transaction
@@ -113,20 +208,24 @@ func DeserializeTransaction(data []byte) Transaction {
 	return transaction
 }
 
-func (tx *Transaction) Hash() []byte {
-	var encoded bytes.Buffer
-	var hash [32]byte
-
-	enc := gob.NewEncoder(&encoded)
-
-	err := enc.Encode(tx)
-
-	if err != nil {
-		panic(err)
+// SignalsReplacement reports whether tx opts in to being replaced in the
+// mempool.
+func (tx *Transaction) SignalsReplacement() bool {
+	for _, vin := range tx.Vin {
+		if vin.Sequence <= MaxReplaceableSequence {
+			return true
+		}
 	}
+	return false
+}
 
-	hash = sha256.Sum256(encoded.Bytes())
+// Size returns the length of tx's serialization.
+func (tx *Transaction) Size() int {
+	return len(tx.Serialize())
+}
 
+func (tx *Transaction) Hash() []byte {
+	hash := sha256.Sum256(tx.Serialize())
 	return hash[:]
 }
 
@@ -139,6 +238,29 @@ func (tx Transaction) IsCoinbase() bool {
 	return len(tx.Vin) == 1 && len(tx.Vin[0].Txid) == 0 && tx.Vin[0].Vout == -1
 }
 
+// IsFinal reports whether tx may be included in a block at height whose
+// median time past is blockTime.
+func (tx Transaction) IsFinal(height int, blockTime int64) bool {
+	if tx.LockTime == 0 {
+		return true
+	}
+
+	limit := int64(height)
+	if tx.LockTime >= LockTimeThreshold {
+		limit = blockTime
+	}
+	if int64(tx.LockTime) < limit {
+		return true
+	}
+
+	for _, vin := range tx.Vin {
+		if vin.Sequence != SequenceFinal {
+			return false
+		}
+	}
+	return true
+}
+
 func (bc *Blockchain) FindUnspentTransactions(pubKeyHash []byte) []Transaction {
 	var unspentTXs []Transaction
 	spentTXOs := make(map[string][]int)
@@ -195,97 +317,202 @@ func (bc *Blockchain) FindUnspentTransactions(pubKeyHash []byte) []Transaction {
 	return unspentTXs
 }
 
-func (bc *Blockchain) FindUTXO() map[string]TXOutputs {
+// NewUTXOTransaction returns a transaction paying amount from from to to.
+// Its fee is at least fee and at least feeRate, or minRelayFeeRate if that
+// is higher, per feeRateSize bytes of the signed transaction, and is taken
+// from the change. Change that would be dust at feeRate is added to the
+// fee, which may not exceed maxFee. Coins are chosen by selector, and a
+// replaceable transaction can later have its fee bumped.
+func NewUTXOTransaction(from, to string, amount, fee, feeRate, maxFee int, replaceable bool, selector CoinSelector, bc *Blockchain) *Transaction {
+	redeemScript, sign := walletSigner(from, bc)
+	tx := fundTransaction(from, []TXOutput{*NewTXOutput(amount, to)}, fee, feeRate, replaceable, selector, redeemScript, bc, sign)
+	checkMaxFee(tx, maxFee, bc)
+	return tx
+}
 
-	UTXO := make(map[string]TXOutputs)
-	spentTXOs := make(map[string][]int)
+// walletSigner returns the redeem script of from if it is a timelocked
+// script address, and a function signing transactions spending from it
+// with the key in the wallet.
+func walletSigner(from string, bc *Blockchain) ([]byte, func(*Transaction)) {
+	wallets, err := NewWallets()
 
-	bci := bc.Iterator()
+	if err != nil {
+		panic(err)
+	}
 
-	for {
+	// Timelocked addresses are spent by the key in their redeem script.
+	redeemScript, isScript := wallets.Scripts[from]
+	keyAddress := from
+	if isScript {
+		_, _, pubKeyHash, ok := extractTimeLockScript(redeemScript)
+		if !ok {
+			log.Panic("ERROR: Spend from multisig addresses with createmultisigtx")
+		}
+		keyAddress = string(encodeAddress(version, pubKeyHash))
+	}
 
-		block := bci.Next()
+	wallet, ok := wallets.Wallets[keyAddress]
+	if !ok {
+		log.Panicf("ERROR: No key for %s in wallet", from)
+	}
 
-		for _, tx := range block.Transactions {
-			txID := hex.EncodeToString(tx.ID)
+	return redeemScript, func(tx *Transaction) {
+		if isScript {
+			tx.SignScriptHash(wallet, redeemScript)
+		} else {
+			bc.SignTransaction(tx, wallet)
+		}
+	}
+}
 
-		Outputs:
-			for outIdx, out := range tx.Vout {
+// fundTransaction builds a transaction as NewUTXOTransaction describes
+// making payments from from, which pays to redeemScript if it is a script
+// address. A timelock redeem script sets the transaction's or its inputs'
+// locks as it requires. sign must set the unlocking scripts, or ones of
+// the same size. The fee is not checked against a maximum.
+func fundTransaction(from string, payments []TXOutput, fee, feeRate int, replaceable bool, selector CoinSelector, redeemScript []byte, bc *Blockchain, sign func(*Transaction)) *Transaction {
+	if feeRate < minRelayFeeRate {
+		feeRate = minRelayFeeRate
+	}
 
-				if spentTXOs[txID] != nil {
-					for _, spentOut := range spentTXOs[txID] {
-						if spentOut == outIdx {
-							continue Outputs
-						}
-					}
-				}
-				outs := UTXO[txID]
-				outs.Outputs = append(outs.Outputs, out)
-				UTXO[txID] = outs
+	amount := 0
+	for _, payment := range payments {
+		if !payment.IsUnspendable() && isDust(payment.Value, feeRate) {
+			log.Panicf("ERROR: Amount %d is dust", payment.Value)
+		}
+		amount += payment.Value
+	}
 
-			}
+	var lockTime int64
+	sequence := int64(NonReplaceableSequence)
+	if replaceable {
+		sequence = MaxReplaceableSequence
+	}
+	if op, lock, _, ok := extractTimeLockScript(redeemScript); ok {
+		if op == OP_CHECKLOCKTIMEVERIFY {
+			lockTime = lock
+		} else {
+			sequence = lock
+		}
+	}
 
-			if !tx.IsCoinbase() {
-				for _, in := range tx.Vin {
-					inTxID := hex.EncodeToString(in.Txid)
-					spentTXOs[inTxID] = append(spentTXOs[inTxID], in.Vout)
+	_, fromHash := decodeAddress([]byte(from))
+	UTXOSet := UTXOSet{bc}
 
-				}
-			}
+	// The size, and so the fee, is only known once the transaction is
+	// signed, so it is rebuilt until the fee covers it.
+	for {
+		inputs, acc := UTXOSet.SelectInputs(fromHash, amount+fee, feeRate, selector, uint32(sequence))
 
-		}
+		outputs := append([]TXOutput{}, payments...)
 
-		if len(block.PrevBlockHash) == 0 {
-			break
+		if change := acc - amount - fee; change > 0 && !isDust(change, feeRate) {
+			outputs = append(outputs, *NewTXOutput(change, from))
 		}
-	}
 
-	return UTXO
+		tx := Transaction{nil, inputs, outputs, uint32(lockTime)}
+		tx.SetId()
+		sign(&tx)
 
-}
+		required := (feeRate*tx.Size() + feeRateSize - 1) / feeRateSize
+		if fee < required {
+			fee = required
+			continue
+		}
 
-func NewUTXOTransaction(from, to string, amount int, bc *Blockchain) *Transaction {
+		return &tx
+	}
+}
 
-	var inputs []TXInput
-	var outputs []TXOutput
+// checkMaxFee panics if tx, spending coins of bc, pays a fee above
+// maxFee.
+func checkMaxFee(tx *Transaction, maxFee int, bc *Blockchain) {
+	if fee := bc.TransactionFee(tx); fee > maxFee {
+		log.Panicf("ERROR: Fee of %d is above the maximum of %d", fee, maxFee)
+	}
+}
 
-	wallets, err := NewWallets()
+// NewBumpFeeTransaction returns a replacement for orig, a replaceable
+// wallet transaction in mp, that takes a higher fee out of its change. The
+// fee is at least fee and at least feeRate, or minRelayFeeRate if that is
+// higher, per feeRateSize bytes, both the fee and fee rate are higher than
+// orig's, and the fee is at most maxFee.
+func NewBumpFeeTransaction(orig *Transaction, fee, feeRate, maxFee int, mp Mempool, bc *Blockchain) *Transaction {
+	if !orig.SignalsReplacement() {
+		log.Panicf("ERROR: Transaction %x is not replaceable", orig.ID)
+	}
+	if feeRate < minRelayFeeRate {
+		feeRate = minRelayFeeRate
+	}
 
+	prevOuts, err := bc.prevOutputs(orig)
 	if err != nil {
-		panic(err)
+		log.Panic(err)
+	}
+	prevOut := prevOuts[hex.EncodeToString(outpointKey(orig.Vin[0].Txid, orig.Vin[0].Vout))]
+	fromHash := prevOut.AddressHash()
+	from := string(encodeAddress(version, fromHash))
+	if isPayToScriptHash(prevOut.LockingScript()) {
+		from = string(encodeAddress(scriptVersion, fromHash))
 	}
+	_, sign := walletSigner(from, bc)
 
-	wallet := wallets.GetWallet(from)
-	UTXOSet := UTXOSet{bc}
-	acc, validOutputs := UTXOSet.FindSpendableOutputs(HashPubKey(wallet.PublicKey), amount)
+	change := -1
+	for outIdx, out := range orig.Vout {
+		if bytes.Equal(out.AddressHash(), fromHash) {
+			change = outIdx
+		}
+	}
+	if change < 0 {
+		log.Panic("ERROR: Transaction has no change to pay a higher fee from")
+	}
 
-	if acc < amount {
-		log.Panic("ERROR: Not enough funds")
+	origFee := mp.Fee(bc, orig)
+	if fee <= origFee {
+		fee = origFee + 1
 	}
 
-	for txid, outs := range validOutputs {
-		txID, err := hex.DecodeString(txid)
-		if err != nil {
-			panic(err)
+	for {
+		inputs := append([]TXInput{}, orig.Vin...)
+		for inID := range inputs {
+			inputs[inID].ScriptSig = nil
+		}
+		outputs := append([]TXOutput{}, orig.Vout...)
+		outputs[change].Value -= fee - origFee
+		if outputs[change].Value < 0 {
+			log.Panicf("ERROR: Change of %d cannot pay a fee of %d", orig.Vout[change].Value, fee)
 		}
-		for _, out := range outs {
-			input := TXInput{txID, out, nil, wallet.PublicKey}
-			inputs = append(inputs, input)
+		if outputs[change].Value == 0 {
+			outputs = append(outputs[:change], outputs[change+1:]...)
 		}
 
-	}
+		tx := Transaction{nil, inputs, outputs, orig.LockTime}
+		tx.SetId()
+		sign(&tx)
 
-	outputs = append(outputs, *NewTXOutput(amount, to))
+		required := (feeRate*tx.Size() + feeRateSize - 1) / feeRateSize
+		if fee*orig.Size() <= origFee*tx.Size() && required <= fee {
+			required = fee + 1
+		}
+		if fee < required {
+			fee = required
+			continue
+		}
+		if fee > maxFee {
+			log.Panicf("ERROR: Fee of %d is above the maximum of %d", fee, maxFee)
+		}
 
-	if acc > amount {
-		outputs = append(outputs, *NewTXOutput(acc-amount, from))
+		return &tx
 	}
+}
 
-	tx := Transaction{nil, inputs, outputs}
-	tx.SetId()
-	bc.SignTransaction(&tx, wallet.PrivateKey)
-
-	return &tx
+// NewDataTransaction returns a transaction from from's coins that stores
+// data on chain in a data output, paying a fee as NewUTXOTransaction does.
+func NewDataTransaction(from string, data []byte, fee, feeRate, maxFee int, bc *Blockchain) *Transaction {
+	redeemScript, sign := walletSigner(from, bc)
+	tx := fundTransaction(from, []TXOutput{*NewDataOutput(data)}, fee, feeRate, false, LargestFirst{}, redeemScript, bc, sign)
+	checkMaxFee(tx, maxFee, bc)
+	return tx
 }
 
 // func (bc *Blockchain) FindSpendableOutputs(pubKeyHash []byte, amount int) (int, map[string][]int) {
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"math/bits"
+)
+
+// Transactions are gob encoded, and gob writes into its output a number
+// for each type that depends on what the process encoded first, while
+// txids, signature hashes and merkle roots are hashes of that output. So
+// transactions are encoded here by hand, in the same format with fixed
+// type numbers, and decoded by gob as usual.
+
+// transactionTypes are the gob type definitions that begin every
+// transaction encoding: Transaction, TXInput, []TXInput, TXOutput and
+// []TXOutput, numbered 70 to 74.
+var transactionTypes = mustDecodeHex("" +
+	"40ff8b0301010b5472616e73616374696f6e01ff8c00010401024944010a00010356696e01ff90000104566f757401ff940001084c6f636b54696d650106000000" +
+	"1dff8f0201010e5b5d6d61696e2e5458496e70757401ff900001ff8e0000" +
+	"5bff8d030101075458496e70757401ff8e000106010454786964010a000104566f757401040001095369676e6174757265010a0001065075624b6579010a000109536372697074536967010a00010853657175656e63650106000000" +
+	"1eff930201010f5b5d6d61696e2e54584f757470757401ff940001ff920000" +
+	"40ff910301010854584f757470757401ff92000103010556616c7565010400010a5075624b657948617368010a00010c5363726970745075624b6579010a000000")
+
+const transactionType = 70
+
+// legacyTransactionTypes are the type definitions that began the encoding
+// of every transaction signed before scripts existed, with only the fields
+// the types had then, numbered 65 to 69 as the wallets that signed them
+// numbered them.
+var legacyTransactionTypes = mustDecodeHex("" +
+	"33ff810301010b5472616e73616374696f6e01ff8200010301024944010a00010356696e01ff86000104566f757401ff8a000000" +
+	"1dff850201010e5b5d6d61696e2e5458496e70757401ff860001ff840000" +
+	"40ff83030101075458496e70757401ff84000104010454786964010a000104566f757401040001095369676e6174757265010a0001065075624b6579010a000000" +
+	"1eff890201010f5b5d6d61696e2e54584f757470757401ff8a0001ff880000" +
+	"2fff870301010854584f757470757401ff88000102010556616c7565010400010a5075624b657948617368010a000000")
+
+const legacyTransactionType = 65
+
+func mustDecodeHex(s string) []byte {
+	data, err := hex.DecodeString(s)
+	if err != nil {
+		panic(err)
+	}
+	return data
+}
+
+// encodeTransaction returns the gob encoding of tx.
+func encodeTransaction(tx *Transaction) []byte {
+	value := newGobStruct(appendGobInt(nil, transactionType))
+	value.bytes(0, tx.ID)
+	value.structs(1, len(tx.Vin), func(i int, f *gobStruct) {
+		vin := tx.Vin[i]
+		f.bytes(0, vin.Txid)
+		f.int(1, vin.Vout)
+		f.bytes(2, vin.Signature)
+		f.bytes(3, vin.PubKey)
+		f.bytes(4, vin.ScriptSig)
+		f.uint(5, uint64(vin.Sequence))
+	})
+	value.structs(2, len(tx.Vout), func(i int, f *gobStruct) {
+		vout := tx.Vout[i]
+		f.int(0, vout.Value)
+		f.bytes(1, vout.PubKeyHash)
+		f.bytes(2, vout.ScriptPubKey)
+	})
+	value.uint(3, uint64(tx.LockTime))
+
+	return gobMessage(transactionTypes, value.end())
+}
+
+// encodeLegacyTransaction returns the gob encoding of tx as it was before
+// scripts existed, with ID id, no signatures and pubKeyHash in place of
+// the public key of input inID only.
+func encodeLegacyTransaction(tx *Transaction, id []byte, inID int, pubKeyHash []byte) []byte {
+	value := newGobStruct(appendGobInt(nil, legacyTransactionType))
+	value.bytes(0, id)
+	value.structs(1, len(tx.Vin), func(i int, f *gobStruct) {
+		f.bytes(0, tx.Vin[i].Txid)
+		f.int(1, tx.Vin[i].Vout)
+		if i == inID {
+			f.bytes(3, pubKeyHash)
+		}
+	})
+	value.structs(2, len(tx.Vout), func(i int, f *gobStruct) {
+		f.int(0, tx.Vout[i].Value)
+		f.bytes(1, tx.Vout[i].PubKeyHash)
+	})
+
+	return gobMessage(legacyTransactionTypes, value.end())
+}
+
+// gobMessage returns the type definitions types followed by the value
+// message value, prefixed with its length.
+func gobMessage(types, value []byte) []byte {
+	data := append([]byte{}, types...)
+	data = appendGobUint(data, uint64(len(value)))
+	return append(data, value...)
+}
+
+// gobStruct appends a gob encoded struct to buf. Fields must be added in
+// order, and ones with zero values are left out, as gob leaves them out.
+type gobStruct struct {
+	buf  []byte
+	last int
+}
+
+func newGobStruct(buf []byte) *gobStruct {
+	return &gobStruct{buf, -1}
+}
+
+// field starts field n, written as its distance from the last one.
+func (s *gobStruct) field(n int) {
+	s.buf = appendGobUint(s.buf, uint64(n-s.last))
+	s.last = n
+}
+
+func (s *gobStruct) int(n, v int) {
+	if v != 0 {
+		s.field(n)
+		s.buf = appendGobInt(s.buf, int64(v))
+	}
+}
+
+func (s *gobStruct) uint(n int, v uint64) {
+	if v != 0 {
+		s.field(n)
+		s.buf = appendGobUint(s.buf, v)
+	}
+}
+
+func (s *gobStruct) bytes(n int, v []byte) {
+	if len(v) != 0 {
+		s.field(n)
+		s.buf = appendGobUint(s.buf, uint64(len(v)))
+		s.buf = append(s.buf, v...)
+	}
+}
+
+// structs adds a slice of count structs, the fields of each added by
+// encode.
+func (s *gobStruct) structs(n, count int, encode func(i int, f *gobStruct)) {
+	if count == 0 {
+		return
+	}
+	s.field(n)
+	s.buf = appendGobUint(s.buf, uint64(count))
+	for i := 0; i < count; i++ {
+		f := newGobStruct(s.buf)
+		encode(i, f)
+		s.buf = f.end()
+	}
+}
+
+// end closes the struct and returns its encoding.
+func (s *gobStruct) end() []byte {
+	return append(s.buf, 0)
+}
+
+// appendGobUint appends u as gob encodes unsigned integers: in one byte
+// below 128, otherwise as the negated count of its big-endian bytes
+// followed by them.
+func appendGobUint(buf []byte, u uint64) []byte {
+	if u < 0x80 {
+		return append(buf, byte(u))
+	}
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], u)
+	n := bits.LeadingZeros64(u) / 8
+	return append(append(buf, byte(-(8-n))), b[n:]...)
+}
+
+// appendGobInt appends i as gob encodes signed integers: shifted left one
+// bit, and complemented first with the low bit set if negative.
+func appendGobInt(buf []byte, i int64) []byte {
+	if i < 0 {
+		return appendGobUint(buf, uint64(^i)<<1|1)
+	}
+	return appendGobUint(buf, uint64(i)<<1)
+}
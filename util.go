@@ -15,3 +15,9 @@ func IntToHex(num int64) []byte {
 
 	return buff.Bytes()
 }
+
+func ReverseHashes(hashes [][]byte) {
+	for i, j := 0, len(hashes)-1; i < j; i, j = i+1, j-1 {
+		hashes[i], hashes[j] = hashes[j], hashes[i]
+	}
+}
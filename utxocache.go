@@ -0,0 +1,388 @@
+package main
+
+import (
+	"bytes"
+	"encoding/gob"
+	"sync"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+const chainstateBucket = "chainstate"
+const undoBucket = "undo"
+
+// chainstateVersion is bumped when the utxoset format changes, making
+// older databases reindex on open. Version 1 added coin heights.
+const chainstateVersion = 1
+
+const utxoCacheSize = 100000
+const utxoFlushInterval = 5 * time.Minute
+
+// SpentOutput records an output spent by a block so the block can be
+// disconnected again.
+type SpentOutput struct {
+	Outpoint []byte
+	Output   TXOutput
+	Height   int
+}
+
+type BlockUndo struct {
+	Spent []SpentOutput
+}
+
+func (u BlockUndo) Serialize() []byte {
+	var buff bytes.Buffer
+	enc := gob.NewEncoder(&buff)
+	err := enc.Encode(u)
+	if err != nil {
+		panic(err)
+	}
+
+	return buff.Bytes()
+}
+
+func DeserializeBlockUndo(data []byte) BlockUndo {
+	var undo BlockUndo
+	dec := gob.NewDecoder(bytes.NewReader(data))
+	err := dec.Decode(&undo)
+	if err != nil {
+		panic(err)
+	}
+	return undo
+}
+
+type utxoCacheEntry struct {
+	coin  Coin
+	spent bool
+	dirty bool
+	// fresh entries do not exist in the db yet, so spending one
+	// can drop it from the cache without ever writing it.
+	fresh bool
+}
+
+// UTXOCache sits in front of the utxoset bucket. Connecting and
+// disconnecting blocks only changes the coins in memory; they are written
+// with the blocks' undo data and the chainstate marker, which names the
+// last block applied, in a single transaction once the cache grows past
+// utxoCacheSize entries, utxoFlushInterval has passed, or on Close. After
+// a crash the marker trails the tip and recoverChainstate replays the
+// blocks in between.
+type UTXOCache struct {
+	mu        sync.Mutex
+	db        *bolt.DB
+	entries   map[string]*utxoCacheEntry
+	undo      map[string][]byte
+	bestBlock []byte
+	lastFlush time.Time
+}
+
+func NewUTXOCache(db *bolt.DB) *UTXOCache {
+	return &UTXOCache{
+		db:        db,
+		entries:   make(map[string]*utxoCacheEntry),
+		undo:      make(map[string][]byte),
+		lastFlush: time.Now(),
+	}
+}
+
+// fetch returns the cache entry for outpoint, loading it through t on a
+// miss. It returns nil if the output does not exist.
+func (c *UTXOCache) fetch(t *bolt.Tx, outpoint []byte) *utxoCacheEntry {
+	if entry, ok := c.entries[string(outpoint)]; ok {
+		return entry
+	}
+
+	b := t.Bucket([]byte(utxoBucket))
+	if b == nil {
+		return nil
+	}
+	data := b.Get(outpoint)
+	if data == nil {
+		return nil
+	}
+
+	entry := &utxoCacheEntry{coin: DeserializeCoin(data)}
+	c.entries[string(outpoint)] = entry
+	return entry
+}
+
+// FetchCoin returns the unspent coin at outpoint.
+func (c *UTXOCache) FetchCoin(outpoint []byte) (Coin, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var entry *utxoCacheEntry
+	err := c.db.View(func(t *bolt.Tx) error {
+		entry = c.fetch(t, outpoint)
+		return nil
+	})
+	if err != nil {
+		panic(err)
+	}
+
+	if entry == nil || entry.spent {
+		return Coin{}, false
+	}
+	return entry.coin, true
+}
+
+func (c *UTXOCache) addCoin(outpoint []byte, coin Coin) {
+	entry, ok := c.entries[string(outpoint)]
+	fresh := !ok || entry.fresh
+	c.entries[string(outpoint)] = &utxoCacheEntry{coin: coin, dirty: true, fresh: fresh}
+}
+
+func (c *UTXOCache) spendOutput(t *bolt.Tx, outpoint []byte) *utxoCacheEntry {
+	entry := c.fetch(t, outpoint)
+	if entry == nil || entry.spent {
+		return nil
+	}
+
+	if entry.fresh {
+		delete(c.entries, string(outpoint))
+		return entry
+	}
+	entry.spent = true
+	entry.dirty = true
+	return entry
+}
+
+// applyBlock spends the inputs and adds the outputs of every transaction
+// in block, reading missing coins through t, and queues the block's undo
+// data for the next flush.
+func (c *UTXOCache) applyBlock(t *bolt.Tx, block *Block) {
+	var undo BlockUndo
+
+	for _, tx := range block.Transactions {
+		if !tx.IsCoinbase() {
+			for _, vin := range tx.Vin {
+				outpoint := outpointKey(vin.Txid, vin.Vout)
+				if entry := c.spendOutput(t, outpoint); entry != nil {
+					undo.Spent = append(undo.Spent, SpentOutput{outpoint, entry.coin.Output, entry.coin.Height})
+				}
+			}
+		}
+
+		for outIdx, out := range tx.Vout {
+			if out.IsUnspendable() {
+				continue
+			}
+			c.addCoin(outpointKey(tx.ID, outIdx), Coin{out, block.Height})
+		}
+	}
+
+	c.undo[string(block.Hash)] = undo.Serialize()
+	c.bestBlock = block.Hash
+}
+
+// undoBlock reverses applyBlock for block using the coins it spent.
+func (c *UTXOCache) undoBlock(t *bolt.Tx, block *Block, undo BlockUndo) {
+	spent := make(map[string]Coin)
+	for _, s := range undo.Spent {
+		spent[string(s.Outpoint)] = Coin{s.Output, s.Height}
+	}
+
+	for i := len(block.Transactions) - 1; i >= 0; i-- {
+		tx := block.Transactions[i]
+		for outIdx := range tx.Vout {
+			c.spendOutput(t, outpointKey(tx.ID, outIdx))
+		}
+
+		if tx.IsCoinbase() {
+			continue
+		}
+		for _, vin := range tx.Vin {
+			outpoint := outpointKey(vin.Txid, vin.Vout)
+			if coin, ok := spent[string(outpoint)]; ok {
+				c.addCoin(outpoint, coin)
+			}
+		}
+	}
+
+	c.bestBlock = block.PrevBlockHash
+}
+
+// Commit runs fn, which may apply blocks to the cache, and writes the
+// resulting UTXO changes in the same db transaction. If the transaction
+// fails the cache is dropped, as it no longer matches the db.
+func (c *UTXOCache) Commit(fn func(t *bolt.Tx) error) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	err := c.db.Update(func(t *bolt.Tx) error {
+		err := fn(t)
+		if err != nil {
+			return err
+		}
+		return c.flushTx(t)
+	})
+	if err != nil {
+		c.entries = make(map[string]*utxoCacheEntry)
+		c.undo = make(map[string][]byte)
+		c.bestBlock = nil
+		return err
+	}
+
+	c.markFlushed()
+	return nil
+}
+
+// ApplyBlock applies block to the cache without writing it, flushing
+// afterwards if the cache is full or stale.
+func (c *UTXOCache) ApplyBlock(block *Block) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	err := c.db.View(func(t *bolt.Tx) error {
+		c.applyBlock(t, block)
+		return nil
+	})
+	if err != nil {
+		panic(err)
+	}
+	c.flushIfStale()
+}
+
+// BlockUndo returns the undo data of the block hash, whether it is still
+// pending in the cache or has been flushed.
+func (c *UTXOCache) BlockUndo(hash []byte) (BlockUndo, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	data, ok := c.undo[string(hash)]
+	if !ok {
+		err := c.db.View(func(t *bolt.Tx) error {
+			if b := t.Bucket([]byte(undoBucket)); b != nil {
+				data = b.Get(hash)
+			}
+			if data != nil {
+				data = append([]byte{}, data...)
+			}
+			return nil
+		})
+		if err != nil {
+			panic(err)
+		}
+	}
+	if data == nil {
+		return BlockUndo{}, false
+	}
+	return DeserializeBlockUndo(data), true
+}
+
+// DisconnectBlock reverses block in the cache using its undo data, without
+// writing it, flushing afterwards if the cache is full or stale.
+func (c *UTXOCache) DisconnectBlock(block *Block, undo BlockUndo) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	err := c.db.View(func(t *bolt.Tx) error {
+		c.undoBlock(t, block, undo)
+		return nil
+	})
+	if err != nil {
+		panic(err)
+	}
+	// A nil entry deletes the undo data on the next flush.
+	c.undo[string(block.Hash)] = nil
+	c.flushIfStale()
+}
+
+func (c *UTXOCache) flushIfStale() {
+	if len(c.entries) >= utxoCacheSize || time.Since(c.lastFlush) >= utxoFlushInterval {
+		c.flush()
+	}
+}
+
+// Flush writes every dirty entry, pending undo data and the best block
+// marker to the db in one transaction.
+func (c *UTXOCache) Flush() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.flush()
+}
+
+func (c *UTXOCache) flush() {
+	err := c.db.Update(c.flushTx)
+	if err != nil {
+		panic(err)
+	}
+	c.markFlushed()
+}
+
+// flushTx writes the dirty state of the cache within t. The cache is not
+// marked clean until the caller has committed t and called markFlushed.
+func (c *UTXOCache) flushTx(t *bolt.Tx) error {
+	for key, entry := range c.entries {
+		if !entry.dirty {
+			continue
+		}
+
+		var err error
+		if entry.spent {
+			err = deleteUTXO(t, []byte(key), entry.coin.Output)
+		} else {
+			err = putUTXO(t, []byte(key), entry.coin)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	undoB, err := t.CreateBucketIfNotExists([]byte(undoBucket))
+	if err != nil {
+		return err
+	}
+	for hash, undo := range c.undo {
+		var err error
+		if undo == nil {
+			err = undoB.Delete([]byte(hash))
+		} else {
+			err = undoB.Put([]byte(hash), undo)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	if c.bestBlock != nil {
+		b, err := t.CreateBucketIfNotExists([]byte(chainstateBucket))
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte("l"), c.bestBlock)
+	}
+	return nil
+}
+
+// markFlushed drops spent coins and marks the rest clean, keeping recent
+// coins around to serve lookups unless the cache is full.
+func (c *UTXOCache) markFlushed() {
+	for key, entry := range c.entries {
+		if entry.spent {
+			delete(c.entries, key)
+			continue
+		}
+		entry.dirty = false
+		entry.fresh = false
+	}
+	if len(c.entries) >= utxoCacheSize {
+		c.entries = make(map[string]*utxoCacheEntry)
+	}
+
+	c.undo = make(map[string][]byte)
+	c.lastFlush = time.Now()
+}
+
+// Reset drops every cached entry without writing it, for use when the
+// utxoset is rewritten underneath the cache.
+func (c *UTXOCache) Reset() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.entries = make(map[string]*utxoCacheEntry)
+	c.undo = make(map[string][]byte)
+	c.bestBlock = nil
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/boltdb/bolt"
+)
+
+// TestUTXOCacheFlushInterrupted writes a flush in a db transaction that
+// fails to commit, as one cut short by a crash would, and checks that
+// reopening the chain replays the block the flush was writing.
+func TestUTXOCacheFlushInterrupted(t *testing.T) {
+	useTestDir(t)
+	from := newTestWallet(t)
+	to := newTestWallet(t)
+	bc := NewBlockChain(from)
+	genesis := bc.tip
+
+	tx := NewUTXOTransaction(from, to, 5, 0, 0, maxTxFee, false, BranchAndBound{}, bc)
+	bc.MineBlock([]*Transaction{NewCoinbaseTx(from, "", bc.TransactionFee(tx)), tx})
+	tip := bc.tip
+
+	errCrash := errors.New("crash")
+	err := bc.db.Update(func(t *bolt.Tx) error {
+		if err := bc.utxo.flushTx(t); err != nil {
+			return err
+		}
+		return errCrash
+	})
+	if err != errCrash {
+		t.Fatalf("flush returned %v, want %v", err, errCrash)
+	}
+	if marker := chainstateMarker(t, bc); !bytes.Equal(marker, genesis) {
+		t.Fatalf("UTXO set at %x after the failed flush, want genesis %x", marker, genesis)
+	}
+	bc.db.Close()
+
+	bc = NewBlockChain(from)
+	defer bc.Close()
+
+	if marker := chainstateMarker(t, bc); !bytes.Equal(marker, tip) {
+		t.Errorf("UTXO set flushed at %x after recovery, want the tip %x", marker, tip)
+	}
+	if info := (UTXOSet{bc}).Info(); info.TotalAmount != 2*subsidy {
+		t.Errorf("UTXO set holds %d after recovery, want %d", info.TotalAmount, 2*subsidy)
+	}
+	if _, ok := bc.utxo.FetchCoin(outpointKey(tx.Vin[0].Txid, tx.Vin[0].Vout)); ok {
+		t.Error("coin spent by the replayed block is unspent")
+	}
+	if coin, ok := bc.utxo.FetchCoin(outpointKey(tx.ID, 0)); !ok || coin.Output.Value != 5 {
+		t.Errorf("payment of the replayed block is %+v, %v, want 5 unspent", coin, ok)
+	}
+}
+
+// TestUTXOCacheFlush checks that a flushed cache is what a fresh cache
+// over the same db reads back, spent coins included.
+func TestUTXOCacheFlush(t *testing.T) {
+	bc, from := newTestBlockchain(t)
+	to := newTestWallet(t)
+
+	tx := NewUTXOTransaction(from, to, 5, 0, 0, maxTxFee, false, BranchAndBound{}, bc)
+	bc.MineBlock([]*Transaction{NewCoinbaseTx(from, "", bc.TransactionFee(tx)), tx})
+	bc.utxo.Flush()
+
+	if marker := chainstateMarker(t, bc); !bytes.Equal(marker, bc.tip) {
+		t.Errorf("UTXO set flushed at %x, want the tip %x", marker, bc.tip)
+	}
+	fresh := NewUTXOCache(bc.db)
+	if _, ok := fresh.FetchCoin(outpointKey(tx.Vin[0].Txid, tx.Vin[0].Vout)); ok {
+		t.Error("spent coin is in the flushed UTXO set")
+	}
+	if coin, ok := fresh.FetchCoin(outpointKey(tx.ID, 0)); !ok || coin.Output.Value != 5 {
+		t.Errorf("payment in the flushed UTXO set is %+v, %v, want 5 unspent", coin, ok)
+	}
+	if _, ok := fresh.BlockUndo(bc.tip); !ok {
+		t.Error("undo data of the tip was not flushed")
+	}
+}
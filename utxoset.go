@@ -1,8 +1,11 @@
 package main
 
 import (
-	"encoding/hex"
-	"log"
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/gob"
+	"fmt"
 
 	"github.com/boltdb/bolt"
 )
@@ -13,57 +16,172 @@ type UTXOSet struct {
 
 const utxoBucket = "utxoset"
 
+const reindexBatchSize = 1000
+
+// addrIndexBucket maps pubKeyHash‖outpoint to the output value so that
+// a single address's coins can be found with a prefix scan.
+const addrIndexBucket = "utxoaddr"
+
+// outpointKey is the utxoset key of output vout of transaction txid.
+func outpointKey(txid []byte, vout int) []byte {
+	key := make([]byte, len(txid)+4)
+	copy(key, txid)
+	binary.BigEndian.PutUint32(key[len(txid):], uint32(vout))
+	return key
+}
+
+func splitOutpointKey(key []byte) ([]byte, int) {
+	n := len(key) - 4
+	return key[:n], int(binary.BigEndian.Uint32(key[n:]))
+}
+
+func addrIndexKey(pubKeyHash, outpoint []byte) []byte {
+	return append(append([]byte{}, pubKeyHash...), outpoint...)
+}
+
+// Coin is an unspent output and the height of the block that created it.
+type Coin struct {
+	Output TXOutput
+	Height int
+}
+
+func (c Coin) Serialize() []byte {
+	var buff bytes.Buffer
+	enc := gob.NewEncoder(&buff)
+	err := enc.Encode(c)
+	if err != nil {
+		panic(err)
+	}
+
+	return buff.Bytes()
+}
+
+func DeserializeCoin(data []byte) Coin {
+	var coin Coin
+	dec := gob.NewDecoder(bytes.NewReader(data))
+	err := dec.Decode(&coin)
+	if err != nil {
+		panic(err)
+	}
+	return coin
+}
+
+// putUTXO adds coin to the utxoset and, if it pays to an address, to the
+// address index.
+func putUTXO(t *bolt.Tx, outpoint []byte, coin Coin) error {
+	err := t.Bucket([]byte(utxoBucket)).Put(outpoint, coin.Serialize())
+	if err != nil {
+		return err
+	}
+
+	hash := coin.Output.AddressHash()
+	if hash == nil {
+		return nil
+	}
+	return t.Bucket([]byte(addrIndexBucket)).Put(addrIndexKey(hash, outpoint), IntToHex(int64(coin.Output.Value)))
+}
+
+// deleteUTXO removes out, stored at outpoint, from the utxoset and the
+// address index.
+func deleteUTXO(t *bolt.Tx, outpoint []byte, out TXOutput) error {
+	if hash := out.AddressHash(); hash != nil {
+		err := t.Bucket([]byte(addrIndexBucket)).Delete(addrIndexKey(hash, outpoint))
+		if err != nil {
+			return err
+		}
+	}
+
+	return t.Bucket([]byte(utxoBucket)).Delete(outpoint)
+}
+
+// ReIndex rebuilds the utxoset by replaying the main chain forward from
+// genesis. Progress is flushed every reindexBatchSize blocks, and an
+// interrupted reindex resumes from the last flushed block on the next call.
 func (u UTXOSet) ReIndex() {
-	db := u.Blockchain.db
+	bc := u.Blockchain
+	db := bc.db
+
+	hashes := bc.GetBlockHashes()
+	ReverseHashes(hashes)
 
-	bucketName := []byte(utxoBucket)
+	bc.utxo.Flush()
+	bc.utxo.Reset()
 
+	start := 0
 	err := db.Update(func(tx *bolt.Tx) error {
-		err := tx.DeleteBucket(bucketName)
+		b, err := tx.CreateBucketIfNotExists([]byte(chainstateBucket))
 		if err != nil {
-			log.Print(err)
+			return err
 		}
-		_, err = tx.CreateBucket(bucketName)
+		err = b.Put([]byte("version"), IntToHex(chainstateVersion))
 		if err != nil {
-			panic(err)
+			return err
+		}
+
+		if b.Get([]byte("reindex")) != nil {
+			marker := b.Get([]byte("l"))
+			for i, hash := range hashes {
+				if bytes.Equal(hash, marker) {
+					start = i + 1
+					fmt.Printf("Resuming reindex at block %d\n", start)
+					return nil
+				}
+			}
 		}
-		return nil
-	})
 
+		for _, name := range []string{utxoBucket, addrIndexBucket} {
+			err := tx.DeleteBucket([]byte(name))
+			if err != nil && err != bolt.ErrBucketNotFound {
+				return err
+			}
+			_, err = tx.CreateBucket([]byte(name))
+			if err != nil {
+				return err
+			}
+		}
+		err = b.Delete([]byte("l"))
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte("reindex"), []byte{1})
+	})
 	if err != nil {
 		panic(err)
 	}
 
-	UTXO := u.Blockchain.FindUTXO()
+	for i := start; i < len(hashes); i++ {
+		block, err := bc.GetBlock(hashes[i])
+		if err != nil {
+			panic(err)
+		}
+		bc.utxo.ApplyBlock(&block)
 
-	err = db.Update(func(t *bolt.Tx) error {
-		b := t.Bucket(bucketName)
-		for txID, outs := range UTXO {
-			key, err := hex.DecodeString(txID)
-			err = b.Put(key, outs.Serialize())
-			if err != nil {
-				panic(err)
-			}
+		if (i+1)%reindexBatchSize == 0 || i == len(hashes)-1 {
+			bc.utxo.Flush()
+			fmt.Printf("Reindexing UTXO set: %d/%d blocks (%.1f%%)\n", i+1, len(hashes), float64(i+1)*100/float64(len(hashes)))
 		}
-		return nil
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(chainstateBucket)).Delete([]byte("reindex"))
 	})
+	if err != nil {
+		panic(err)
+	}
 }
 
 func (u UTXOSet) FindUTXO(pubKeyHash []byte) []TXOutput {
 	var UTXOs []TXOutput
 	db := u.Blockchain.db
 
+	u.Blockchain.utxo.Flush()
+
 	err := db.View(func(tx *bolt.Tx) error {
 		b := tx.Bucket([]byte(utxoBucket))
-		c := b.Cursor()
-		for k, v := c.First(); k != nil; k, v = c.Next() {
-			outs := DeserializeOutputs(v)
+		c := tx.Bucket([]byte(addrIndexBucket)).Cursor()
 
-			for _, out := range outs.Outputs {
-				if out.isLockedWithKey(pubKeyHash) {
-					UTXOs = append(UTXOs, out)
-				}
-			}
+		for k, _ := c.Seek(pubKeyHash); k != nil && bytes.HasPrefix(k, pubKeyHash); k, _ = c.Next() {
+			UTXOs = append(UTXOs, DeserializeCoin(b.Get(k[len(pubKeyHash):])).Output)
 		}
 		return nil
 	})
@@ -75,85 +193,79 @@ func (u UTXOSet) FindUTXO(pubKeyHash []byte) []TXOutput {
 	return UTXOs
 }
 
-func (u UTXOSet) Update(block *Block) {
+// FindSpendableCoins returns every unspent output paying to pubKeyHash.
+func (u UTXOSet) FindSpendableCoins(pubKeyHash []byte) []SpendableCoin {
+	var coins []SpendableCoin
+
 	db := u.Blockchain.db
 
-	err := db.Update(func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte(utxoBucket))
+	u.Blockchain.utxo.Flush()
 
-		for _, tx := range block.Transactions {
-			if tx.IsCoinbase() == false {
-				for _, vin := range tx.Vin {
-					updatedOuts := TXOutputs{}
-					outsBytes := b.Get(vin.Txid)
-					outs := DeserializeOutputs(outsBytes)
-
-					for outIdx, out := range outs.Outputs {
-						if outIdx != vin.Vout {
-							updatedOuts.Outputs = append(updatedOuts.Outputs, out)
-						}
-					}
-					if len(updatedOuts.Outputs) == 0 {
-						err := b.Delete(vin.Txid)
-						if err != nil {
-							panic(err)
-						} else {
-							err := b.Put(vin.Txid, updatedOuts.Serialize())
-							if err != nil {
-								panic(err)
-							}
-						}
-
-					}
-				}
+	err := db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket([]byte(addrIndexBucket)).Cursor()
 
-				newOutputs := TXOutputs{}
-				for _, out := range tx.Vout {
-					newOutputs.Outputs = append(newOutputs.Outputs, out)
-				}
+		for k, v := c.Seek(pubKeyHash); k != nil && bytes.HasPrefix(k, pubKeyHash); k, v = c.Next() {
+			txID, outIdx := splitOutpointKey(k[len(pubKeyHash):])
+			txID = append([]byte{}, txID...)
 
-				err := b.Put(tx.ID, newOutputs.Serialize())
-				if err != nil {
-					panic(err)
-				}
-			}
+			coins = append(coins, SpendableCoin{txID, outIdx, int(binary.BigEndian.Uint64(v))})
 		}
 		return nil
 	})
-
 	if err != nil {
 		panic(err)
 	}
-
+	return coins
 }
 
-func (u UTXOSet) FindSpendableOutputs(pubKeyHash []byte, amount int) (int, map[string][]int) {
-	unspentOutputs := make(map[string][]int)
-
-	accumulated := 0
+type UTXOSetInfo struct {
+	Height         int
+	BestBlock      []byte
+	Transactions   int
+	TxOuts         int
+	TotalAmount    int
+	SerializedSize int
+	Hash           []byte
+}
 
-	db := u.Blockchain.db
+// Info flushes the UTXO cache and summarises the utxoset. Hash commits to
+// every outpoint and serialized coin in key order, so two nodes at the
+// same tip have the same hash iff they have the same chainstate.
+func (u UTXOSet) Info() UTXOSetInfo {
+	var info UTXOSetInfo
+	bc := u.Blockchain
 
-	err := db.View(func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte(utxoBucket))
+	bc.utxo.Flush()
 
-		c := b.Cursor()
+	hasher := sha256.New()
+	err := bc.db.View(func(tx *bolt.Tx) error {
+		info.BestBlock = bc.tip
+		if b := tx.Bucket([]byte(chainstateBucket)); b != nil && b.Get([]byte("l")) != nil {
+			info.BestBlock = append([]byte{}, b.Get([]byte("l"))...)
+		}
+		info.Height = DeserializeBlock(tx.Bucket([]byte(blocksBucket)).Get(info.BestBlock)).Height
 
+		var lastTxID []byte
+		c := tx.Bucket([]byte(utxoBucket)).Cursor()
 		for k, v := c.First(); k != nil; k, v = c.Next() {
-			txId := hex.EncodeToString(k)
-			outs := DeserializeOutputs(v)
-
-			for outIdx, out := range outs.Outputs {
-				if out.isLockedWithKey(pubKeyHash) && accumulated < amount {
-					accumulated += out.Value
-					unspentOutputs[txId] = append(unspentOutputs[txId], outIdx)
-				}
+			txID, _ := splitOutpointKey(k)
+			if !bytes.Equal(txID, lastTxID) {
+				info.Transactions++
+				lastTxID = txID
 			}
+
+			info.TxOuts++
+			info.TotalAmount += DeserializeCoin(v).Output.Value
+			info.SerializedSize += len(k) + len(v)
+			hasher.Write(k)
+			hasher.Write(v)
 		}
 		return nil
 	})
 	if err != nil {
 		panic(err)
 	}
-	return accumulated, unspentOutputs
+
+	info.Hash = hasher.Sum(nil)
+	return info
 }
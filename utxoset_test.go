@@ -0,0 +1,73 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/boltdb/bolt"
+)
+
+// TestReIndexResumes leaves a reindex flagged as running with the UTXO set
+// flushed part of the way, and checks that reopening the chain finishes it
+// from there rather than starting over, which would drop a coin planted in
+// the part already done.
+func TestReIndexResumes(t *testing.T) {
+	useTestDir(t)
+	from := newTestWallet(t)
+	to := newTestWallet(t)
+	bc := NewBlockChain(from)
+
+	tx1 := NewUTXOTransaction(from, to, 5, 0, 0, maxTxFee, false, BranchAndBound{}, bc)
+	bc.MineBlock([]*Transaction{NewCoinbaseTx(from, "", bc.TransactionFee(tx1)), tx1})
+	bc.utxo.Flush()
+	tx2 := NewUTXOTransaction(from, to, 3, 0, 0, maxTxFee, false, BranchAndBound{}, bc)
+	bc.MineBlock([]*Transaction{NewCoinbaseTx(from, "", bc.TransactionFee(tx2)), tx2})
+	tip := bc.tip
+
+	planted := outpointKey(bytes.Repeat([]byte{1}, 32), 0)
+	err := bc.db.Update(func(t *bolt.Tx) error {
+		if err := putUTXO(t, planted, Coin{*NewTXOutput(7, to), 1}); err != nil {
+			return err
+		}
+		return t.Bucket([]byte(chainstateBucket)).Put([]byte("reindex"), []byte{1})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The second block was never flushed, as if the reindex stopped after
+	// the first.
+	bc.db.Close()
+
+	bc = NewBlockChain(from)
+	defer bc.Close()
+
+	var reindexing bool
+	err = bc.db.View(func(t *bolt.Tx) error {
+		reindexing = t.Bucket([]byte(chainstateBucket)).Get([]byte("reindex")) != nil
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reindexing {
+		t.Error("reindex still flagged as running")
+	}
+	if _, ok := bc.utxo.FetchCoin(planted); !ok {
+		t.Error("reindex started over instead of resuming")
+	}
+	if _, ok := bc.utxo.FetchCoin(outpointKey(tx2.Vin[0].Txid, tx2.Vin[0].Vout)); ok {
+		t.Error("coin spent by the second block is unspent")
+	}
+	info := UTXOSet{bc}.Info()
+	if !bytes.Equal(info.BestBlock, tip) || info.TotalAmount != 3*subsidy+7 {
+		t.Errorf("UTXO set at %x holding %d, want the tip %x holding %d", info.BestBlock, info.TotalAmount, tip, 3*subsidy+7)
+	}
+
+	UTXOSet{bc}.ReIndex()
+	if _, ok := bc.utxo.FetchCoin(planted); ok {
+		t.Error("planted coin survived a full reindex")
+	}
+	if info := (UTXOSet{bc}).Info(); info.TotalAmount != 3*subsidy {
+		t.Errorf("UTXO set holds %d after a full reindex, want %d", info.TotalAmount, 3*subsidy)
+	}
+}
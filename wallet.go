@@ -10,6 +10,7 @@ import (
 	"fmt"
 	"io/ioutil"
 	"log"
+	"math/big"
 	"os"
 
 	"golang.org/x/crypto/ripemd160"
@@ -20,14 +21,24 @@ type Wallet struct {
 	PublicKey  []byte
 }
 
+// walletKeys is how a Wallet is stored, as curves cannot be gob encoded.
+type walletKeys struct {
+	D         []byte
+	PublicKey []byte
+}
+
 type Wallets struct {
 	Wallets map[string]*Wallet
+	// Scripts holds the redeem scripts of multisig addresses.
+	Scripts map[string][]byte
+
+	file string
 }
 
 const walletFile = "Wallets"
 
-func NewWallet() *Wallet {
-	private, public := newKeyPair()
+func NewWallet(curve elliptic.Curve) *Wallet {
+	private, public := newKeyPair(curve)
 	wallet := Wallet{private, public}
 	return &wallet
 }
@@ -36,29 +47,125 @@ func (w Wallets) GetWallet(address string) Wallet {
 	return *w.Wallets[address]
 }
 
-func newKeyPair() (ecdsa.PrivateKey, []byte) {
+func (w Wallet) GobEncode() ([]byte, error) {
+	return gobEncode(walletKeys{w.PrivateKey.D.Bytes(), w.PublicKey}), nil
+}
+
+func (w *Wallet) GobDecode(data []byte) error {
+	var keys walletKeys
+	err := gob.NewDecoder(bytes.NewReader(data)).Decode(&keys)
+	if err != nil {
+		return err
+	}
 
+	// The public key names the curve, except in wallets older than that,
+	// which are all on P-256.
 	curve := elliptic.P256()
+	if pubKey, err := parsePubKey(keys.PublicKey); err == nil {
+		curve = pubKey.Curve
+	}
+	w.PrivateKey.Curve = curve
+	w.PrivateKey.D = new(big.Int).SetBytes(keys.D)
+	w.PrivateKey.X, w.PrivateKey.Y = curve.ScalarBaseMult(keys.D)
+	w.PublicKey = keys.PublicKey
+	return nil
+}
+
+func newKeyPair(curve elliptic.Curve) (ecdsa.PrivateKey, []byte) {
 	private, err := ecdsa.GenerateKey(curve, rand.Reader)
 	if err != nil {
 		panic(err)
 	}
-	pubKey := append(private.PublicKey.X.Bytes(), private.PublicKey.Y.Bytes()...)
-	return *private, pubKey
+	return *private, encodePubKey(&private.PublicKey)
+}
+
+// curves are the curves keys can be on, by name.
+var curves = map[string]elliptic.Curve{
+	"p256":      elliptic.P256(),
+	"secp256k1": secp256k1,
+}
+
+// curvePrefixes names the curve of a public key by the high bits of its
+// SEC1 prefix: 0x02, 0x03 and 0x04 are P-256 keys and 0x12, 0x13 and 0x14
+// secp256k1 keys.
+var curvePrefixes = map[byte]elliptic.Curve{
+	0x00: elliptic.P256(),
+	0x10: secp256k1,
+}
+
+const curvePrefixMask = 0xf0
+
+// encodePubKey returns pubKey SEC1 compressed, with its curve's prefix.
+func encodePubKey(pubKey *ecdsa.PublicKey) []byte {
+	encoded := elliptic.MarshalCompressed(pubKey.Curve, pubKey.X, pubKey.Y)
+	for prefix, curve := range curvePrefixes {
+		if curve.Params() == pubKey.Curve.Params() {
+			encoded[0] |= prefix
+			return encoded
+		}
+	}
+	log.Panicf("ERROR: No key encoding for curve %s", pubKey.Curve.Params().Name)
+	return nil
+}
+
+// legacyPubKeySize is the size of the raw X and Y coordinates public keys
+// were once encoded as, still accepted so their outputs stay spendable.
+const legacyPubKeySize = 64
+
+// parsePubKey decodes a SEC1 compressed or uncompressed public key on the
+// curve its prefix names, or a legacy P-256 one, rejecting any other
+// encoding and points off the curve.
+func parsePubKey(pubKey []byte) (*ecdsa.PublicKey, error) {
+	if len(pubKey) == legacyPubKeySize {
+		pubKey = append([]byte{0x04}, pubKey...)
+	}
+	if len(pubKey) == 0 {
+		return nil, fmt.Errorf("invalid public key %x", pubKey)
+	}
+	curve, ok := curvePrefixes[pubKey[0]&curvePrefixMask]
+	if !ok {
+		return nil, fmt.Errorf("invalid public key %x", pubKey)
+	}
+	sec1 := append([]byte{pubKey[0] &^ curvePrefixMask}, pubKey[1:]...)
+	var x, y *big.Int
+
+	switch {
+	case len(sec1) == 65 && sec1[0] == 0x04:
+		x, y = elliptic.Unmarshal(curve, sec1)
+	case len(sec1) == 33 && (sec1[0] == 0x02 || sec1[0] == 0x03):
+		if k, ok := curve.(*koblitzCurve); ok {
+			x, y = k.unmarshalCompressed(sec1)
+		} else {
+			x, y = elliptic.UnmarshalCompressed(curve, sec1)
+		}
+	}
+	if x == nil {
+		return nil, fmt.Errorf("invalid public key %x", pubKey)
+	}
+	return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
 }
 
 const version = byte(0x00)
+const scriptVersion = byte(0x05)
 
-func (ws *Wallets) CreateWallet() string {
-	wallet := NewWallet()
+func (ws *Wallets) CreateWallet(curve elliptic.Curve) string {
+	wallet := NewWallet(curve)
 	address := fmt.Sprintf("%s", wallet.GetAddress())
 	ws.Wallets[address] = wallet
 	return address
 }
 
 func (w Wallet) GetAddress() []byte {
-	pubKeyHash := HashPubKey(w.PublicKey)
-	versionedPayload := append([]byte{version}, pubKeyHash...)
+	return encodeAddress(version, HashPubKey(w.PublicKey))
+}
+
+// ScriptAddress returns the address paying to redeemScript.
+func ScriptAddress(redeemScript []byte) []byte {
+	return encodeAddress(scriptVersion, HashPubKey(redeemScript))
+}
+
+func encodeAddress(version byte, hash []byte) []byte {
+	versionedPayload := append([]byte{version}, hash...)
 
 	checksum := checksum(versionedPayload)
 
@@ -69,6 +176,62 @@ func (w Wallet) GetAddress() []byte {
 	return address
 }
 
+// decodeAddress returns the version byte and hash encoded in address.
+func decodeAddress(address []byte) (byte, []byte) {
+	payload := Base58Decode(address)
+	if len(payload) < 5 {
+		log.Panicf("ERROR: Invalid address %s", address)
+	}
+	return payload[0], payload[1 : len(payload)-4]
+}
+
+// ValidateAddress reports whether address is a key or script address
+// with a valid checksum.
+func ValidateAddress(address string) bool {
+	payload := Base58Decode([]byte(address))
+	if len(payload) != 1+ripemd160.Size+4 || string(Base58Encode(payload)) != address {
+		return false
+	}
+	if payload[0] != version && payload[0] != scriptVersion {
+		return false
+	}
+	return bytes.Equal(checksum(payload[:len(payload)-4]), payload[len(payload)-4:])
+}
+
+// AddMultisig stores an m-of-n redeem script over pubKeys and returns
+// its address.
+func (ws *Wallets) AddMultisig(m int, pubKeys [][]byte) string {
+	redeemScript := MultisigScript(m, pubKeys)
+	if len(redeemScript) > maxScriptElementSize {
+		log.Panicf("ERROR: Redeem script of %d bytes is too large", len(redeemScript))
+	}
+
+	address := string(ScriptAddress(redeemScript))
+	ws.Scripts[address] = redeemScript
+	return address
+}
+
+// AddTimeLock stores a redeem script that locks funds to address until
+// op, OP_CHECKLOCKTIMEVERIFY or OP_CHECKSEQUENCEVERIFY, accepts lock, and
+// returns its address.
+func (ws *Wallets) AddTimeLock(address string, op byte, lock int64) string {
+	addrVersion, pubKeyHash := decodeAddress([]byte(address))
+	if addrVersion != version {
+		log.Panicf("ERROR: %s is not a key address", address)
+	}
+
+	redeemScript := TimeLockScript(op, lock, pubKeyHash)
+	scriptAddress := string(ScriptAddress(redeemScript))
+	ws.Scripts[scriptAddress] = redeemScript
+	return scriptAddress
+}
+
+// FindByPubKey returns the wallet holding the private key for pubKey.
+func (ws Wallets) FindByPubKey(pubKey []byte) (*Wallet, bool) {
+	wallet, ok := ws.Wallets[string(Wallet{PublicKey: pubKey}.GetAddress())]
+	return wallet, ok
+}
+
 func HashPubKey(pubKey []byte) []byte {
 	publicSHA256 := sha256.Sum256(pubKey)
 	RIPEMD160Hasher := ripemd160.New()
@@ -88,24 +251,29 @@ func checksum(payload []byte) []byte {
 }
 
 func NewWallets() (*Wallets, error) {
-	wallets := Wallets{}
+	return LoadWallets(walletFile)
+}
+
+// LoadWallets loads the wallets stored in file, which need not exist yet.
+func LoadWallets(file string) (*Wallets, error) {
+	wallets := Wallets{file: file}
 	wallets.Wallets = make(map[string]*Wallet)
+	wallets.Scripts = make(map[string][]byte)
 	err := wallets.LoadFromFile()
 	return &wallets, err
 }
 
 func (w *Wallets) LoadFromFile() error {
-	if _, err := os.Stat(walletFile); os.IsNotExist(err) {
+	if _, err := os.Stat(w.file); os.IsNotExist(err) {
 		return err
 	}
 
-	fileContent, err := ioutil.ReadFile(walletFile)
+	fileContent, err := ioutil.ReadFile(w.file)
 	if err != nil {
 		return err
 	}
 
 	var wallets Wallets
-	gob.Register(elliptic.P256())
 
 	decoder := gob.NewDecoder(bytes.NewReader(fileContent))
 
@@ -114,6 +282,9 @@ func (w *Wallets) LoadFromFile() error {
 		panic(err)
 	}
 	w.Wallets = wallets.Wallets
+	if wallets.Scripts != nil {
+		w.Scripts = wallets.Scripts
+	}
 
 	return nil
 }
@@ -121,8 +292,6 @@ func (w *Wallets) LoadFromFile() error {
 func (w Wallets) SaveToFile() {
 	var content bytes.Buffer
 
-	gob.Register(elliptic.P256())
-
 	encoder := gob.NewEncoder(&content)
 
 	err := encoder.Encode(w)
@@ -131,7 +300,7 @@ func (w Wallets) SaveToFile() {
 		log.Panic(err)
 	}
 
-	err = ioutil.WriteFile(walletFile, content.Bytes(), 0666)
+	err = ioutil.WriteFile(w.file, content.Bytes(), 0666)
 
 	if err != nil {
 		log.Panic(err)